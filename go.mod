@@ -3,3 +3,14 @@ module github.com/tm8619/MGL-test
 go 1.25
 
 require github.com/go-sql-driver/mysql v1.7.1
+
+require (
+	github.com/lib/pq v1.10.9
+	github.com/redis/go-redis/v9 v9.22.0
+)
+
+require (
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	go.uber.org/atomic v1.11.0 // indirect
+	golang.org/x/sys v0.30.0 // indirect
+)
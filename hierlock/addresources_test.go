@@ -0,0 +1,147 @@
+package hierlock
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func heldTargets(h *LockHandle) map[string]LockMode {
+	out := map[string]LockMode{}
+	for _, hl := range h.Held() {
+		out[hl.Target] = hl.Mode
+	}
+	return out
+}
+
+func TestLockHandle_AddResourcesInOrder(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	setupLockTable(ctx, t, db)
+	seedBuckets(ctx, t, db,
+		userTarget("u1"),
+		accountTarget("u1", "a1"),
+		resourceTarget("u1", "a1", "r1"),
+		resourceTarget("u1", "a1", "r2"),
+		resourceTarget("u1", "a1", "r3"),
+	)
+
+	m := NewManager(db)
+
+	h, err := m.AcquireResources(ctx, "u1", "a1", []string{"r1"})
+	if err != nil {
+		t.Fatalf("AcquireResources: %v", err)
+	}
+	defer h.Release()
+
+	if err := h.AddResources(ctx, "r3", "r2", "r1"); err != nil {
+		t.Fatalf("AddResources: %v", err)
+	}
+	held := heldTargets(h)
+	for _, name := range []string{"Resource(u1/a1/r1)", "Resource(u1/a1/r2)", "Resource(u1/a1/r3)"} {
+		if held[name] != ModeExclusive {
+			t.Fatalf("expected %s held exclusively, got %+v", name, held)
+		}
+	}
+	if _, err := m.TryAcquire(ctx, LevelResource, "u1", "a1", "r3"); !errors.Is(err, ErrWouldBlock) {
+		t.Fatalf("expected added resource to be locked, got: %v", err)
+	}
+}
+
+func TestLockHandle_AddResourcesOrderViolation(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	setupLockTable(ctx, t, db)
+	seedBuckets(ctx, t, db,
+		userTarget("u1"),
+		accountTarget("u1", "a1"),
+		resourceTarget("u1", "a1", "r1"),
+		resourceTarget("u1", "a1", "r5"),
+	)
+
+	m := NewManager(db)
+
+	h, err := m.AcquireResources(ctx, "u1", "a1", []string{"r5"})
+	if err != nil {
+		t.Fatalf("AcquireResources: %v", err)
+	}
+	defer h.Release()
+
+	if err := h.AddResources(ctx, "r1"); !errors.Is(err, ErrLockOrderViolation) {
+		t.Fatalf("expected ErrLockOrderViolation, got: %v", err)
+	}
+	// The handle keeps r5 and did not take r1.
+	if _, err := m.TryAcquire(ctx, LevelResource, "u1", "a1", "r5"); !errors.Is(err, ErrWouldBlock) {
+		t.Fatalf("expected r5 to stay locked, got: %v", err)
+	}
+	other, err := m.TryAcquire(ctx, LevelResource, "u1", "a1", "r1")
+	if err != nil {
+		t.Fatalf("r1 must not be locked after the violation: %v", err)
+	}
+	_ = other.Release()
+}
+
+func TestLockHandle_AddResourcesRestartOnOrderViolation(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	setupLockTable(ctx, t, db)
+	seedBuckets(ctx, t, db,
+		userTarget("u1"),
+		accountTarget("u1", "a1"),
+		resourceTarget("u1", "a1", "r1"),
+		resourceTarget("u1", "a1", "r5"),
+	)
+
+	m := NewManager(db)
+
+	h, err := m.AcquireResources(ctx, "u1", "a1", []string{"r5"}, WithRestartOnOrderViolation())
+	if err != nil {
+		t.Fatalf("AcquireResources: %v", err)
+	}
+	defer h.Release()
+
+	if err := h.AddResources(ctx, "r1"); err != nil {
+		t.Fatalf("AddResources with restart: %v", err)
+	}
+	held := heldTargets(h)
+	if held["Resource(u1/a1/r1)"] != ModeExclusive || held["Resource(u1/a1/r5)"] != ModeExclusive {
+		t.Fatalf("expected r1 and r5 held after restart, got %+v", held)
+	}
+	for _, r := range []string{"r1", "r5"} {
+		if _, err := m.TryAcquire(ctx, LevelResource, "u1", "a1", r); !errors.Is(err, ErrWouldBlock) {
+			t.Fatalf("expected %s locked after restart, got: %v", r, err)
+		}
+	}
+}
+
+func TestLockHandle_AddResourcesRequiresAccount(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	setupLockTable(ctx, t, db)
+	seedBuckets(ctx, t, db, userTarget("u1"))
+
+	m := NewManager(db)
+
+	h, err := m.Acquire(ctx, LevelUser, "u1", "", "")
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	defer h.Release()
+
+	if err := h.AddResources(ctx, "r1"); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("expected ErrInvalidArgument for a User-level handle, got: %v", err)
+	}
+}
@@ -0,0 +1,128 @@
+package hierlock
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+)
+
+// testBackend is a Locker under test together with what the shared matrix
+// tests need to prepare it.
+type testBackend interface {
+	Locker
+	// reset empties the backend's lock storage; provision makes targets
+	// lockable (bucket rows for the MySQL backend).
+	reset(ctx context.Context, t fataler)
+	provision(ctx context.Context, t fataler, targets ...lockTarget)
+	// acquireAccounts locks several Accounts of one User (AcquireAccounts).
+	acquireAccounts(ctx context.Context, userID string, accountIDs []string, opts ...AcquireOption) (Handle, error)
+}
+
+// forEachBackend runs fn as a subtest per backend. Backends whose server is
+// not reachable skip their subtest.
+func forEachBackend(t *testing.T, fn func(t *testing.T, b testBackend)) {
+	t.Run("mysql", func(t *testing.T) {
+		db, cleanup := openTestDB(t)
+		defer cleanup()
+		fn(t, newMySQLBackend(db))
+	})
+	t.Run("named", func(t *testing.T) {
+		db, cleanup := openTestDB(t)
+		defer cleanup()
+		fn(t, namedBackend{NewNamedLocker(db)})
+	})
+	t.Run("postgres-advisory", func(t *testing.T) {
+		db, cleanup := openPostgresDB(t)
+		defer cleanup()
+		fn(t, postgresBackend{NewPostgresLocker(db, PostgresAdvisory), db})
+	})
+	t.Run("postgres-rows", func(t *testing.T) {
+		db, cleanup := openPostgresDB(t)
+		defer cleanup()
+		fn(t, postgresBackend{NewPostgresLocker(db, PostgresBucketRows), db})
+	})
+	t.Run("redis", func(t *testing.T) {
+		client, cleanup := openTestRedis(t)
+		defer cleanup()
+		fn(t, redisBackend{NewRedisLocker(client)})
+	})
+	t.Run("memory", func(t *testing.T) {
+		fn(t, memoryBackend{NewMemoryLocker()})
+	})
+}
+
+type mysqlBackend struct {
+	Locker
+	db *sql.DB
+	m  *Manager
+}
+
+func newMySQLBackend(db *sql.DB) mysqlBackend {
+	m := NewManager(db)
+	return mysqlBackend{Locker: m.Locker(), db: db, m: m}
+}
+
+func (b mysqlBackend) reset(ctx context.Context, t fataler) {
+	setupLockTable(ctx, t, b.db)
+}
+
+func (b mysqlBackend) provision(ctx context.Context, t fataler, targets ...lockTarget) {
+	seedBuckets(ctx, t, b.db, targets...)
+}
+
+func (b mysqlBackend) acquireAccounts(ctx context.Context, userID string, accountIDs []string, opts ...AcquireOption) (Handle, error) {
+	return handle(b.m.AcquireAccounts(ctx, userID, accountIDs, opts...))
+}
+
+type memoryBackend struct {
+	*MemoryLocker
+}
+
+func (memoryBackend) reset(context.Context, fataler) {}
+
+func (memoryBackend) provision(context.Context, fataler, ...lockTarget) {}
+
+func (b memoryBackend) acquireAccounts(ctx context.Context, userID string, accountIDs []string, opts ...AcquireOption) (Handle, error) {
+	return NewLockerRepository(b).GetAccountsLock(ctx, userID, accountIDs, opts...)
+}
+
+type namedBackend struct {
+	*NamedLocker
+}
+
+func (namedBackend) reset(context.Context, fataler) {}
+
+func (namedBackend) provision(context.Context, fataler, ...lockTarget) {}
+
+func (b namedBackend) acquireAccounts(ctx context.Context, userID string, accountIDs []string, opts ...AcquireOption) (Handle, error) {
+	return NewLockerRepository(b).GetAccountsLock(ctx, userID, accountIDs, opts...)
+}
+
+type postgresBackend struct {
+	*PostgresLocker
+	db *sql.DB
+}
+
+func (b postgresBackend) reset(ctx context.Context, t fataler) {
+	setupPostgresLockTables(ctx, t, b.db)
+}
+
+func (b postgresBackend) provision(ctx context.Context, t fataler, targets ...lockTarget) {
+	seedPostgresBuckets(ctx, t, b.db, targets...)
+}
+
+func (b postgresBackend) acquireAccounts(ctx context.Context, userID string, accountIDs []string, opts ...AcquireOption) (Handle, error) {
+	return NewLockerRepository(b).GetAccountsLock(ctx, userID, accountIDs, opts...)
+}
+
+type redisBackend struct {
+	*RedisLocker
+}
+
+func (redisBackend) reset(context.Context, fataler) {}
+
+func (redisBackend) provision(context.Context, fataler, ...lockTarget) {}
+
+func (b redisBackend) acquireAccounts(ctx context.Context, userID string, accountIDs []string, opts ...AcquireOption) (Handle, error) {
+	return NewLockerRepository(b).GetAccountsLock(ctx, userID, accountIDs, opts...)
+}
@@ -0,0 +1,200 @@
+package hierlock
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// BucketCollision lists requested IDs that map to the same (level, bucket)
+// row. Colliding IDs cannot be locked independently of each other.
+type BucketCollision struct {
+	Level  Level
+	Bucket int
+	IDs    []string // each node's own ID, e.g. "r1"
+	// Targets names the nodes, e.g. "Resource(u1/a1/r1)"; it tells nodes
+	// with the same ID under different parents apart.
+	Targets []string
+}
+
+// Claim is the result of ClaimResources.
+type Claim struct {
+	// Handle holds the ancestor locks and the claimed Resource buckets. It is
+	// nil when nothing could be claimed.
+	Handle *LockHandle
+	// Claimed lists the claimed candidate IDs in bucket order.
+	Claimed []string
+	// Collisions lists candidates that share a Resource bucket. Only the first
+	// ID (in candidate order) of each group is ever claimed; the others are
+	// covered by the same row lock and are reported here instead.
+	Collisions []BucketCollision
+}
+
+// Release releases the claim. It is safe to call on an empty claim.
+func (c *Claim) Release() error {
+	if c == nil {
+		return nil
+	}
+	return c.Handle.Release()
+}
+
+// ClaimResources claims up to limit resources under (userID, accountID) that
+// no other transaction currently holds.
+//
+// Rule:
+// - User, Account: shared lock (waits, like Acquire)
+// - Resources: FOR UPDATE SKIP LOCKED on the candidates' buckets, lowest bucket first
+//
+// Busy buckets are skipped instead of waited for, so concurrent workers
+// calling ClaimResources with the same candidates receive disjoint sets.
+// Candidates whose bucket row is not provisioned are skipped as well.
+func (m *Manager) ClaimResources(ctx context.Context, userID, accountID string, candidates []string, limit int) (*Claim, error) {
+	if err := m.check(); err != nil {
+		return nil, err
+	}
+	if userID == "" || accountID == "" {
+		return nil, invalidArgf("userID and accountID are required")
+	}
+	if len(candidates) == 0 {
+		return nil, invalidArgf("candidates is required")
+	}
+	if limit <= 0 {
+		return nil, invalidArgf("limit must be positive")
+	}
+	for _, r := range candidates {
+		if r == "" {
+			return nil, invalidArgf("resourceID is required")
+		}
+	}
+
+	parent := Path{userID, accountID}
+	if err := m.h.validateParent(parent); err != nil {
+		return nil, err
+	}
+	byBucket, collisions := m.h.childCandidates(parent, candidates)
+	claim := &Claim{Collisions: collisions}
+
+	conn, tx, err := m.beginLockTx(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rollback := func(cause error) (*Claim, error) {
+		_ = tx.Rollback()
+		closeLockConn(conn, errors.Is(cause, errLockWaitNotReset))
+		return nil, cause
+	}
+
+	ancestors, err := m.parentSteps(parent, ModeExclusive)
+	if err != nil {
+		return rollback(err)
+	}
+	m.assignSlots(ancestors, m.nextSlot())
+	m.checkOrder(ctx, ancestors)
+	if err := lockSteps(ctx, tx, ancestors, acquireConfig{}); err != nil {
+		return rollback(err)
+	}
+
+	buckets, err := claimBuckets(ctx, tx, m.h.levels[len(parent)].ID, byBucket, limit)
+	if err != nil {
+		return rollback(m.h.claimError(parent, err))
+	}
+	if len(buckets) == 0 {
+		_ = tx.Rollback()
+		closeLockConn(conn, false)
+		return claim, nil
+	}
+	steps := ancestors
+	for _, b := range buckets {
+		claim.Claimed = append(claim.Claimed, byBucket[b])
+		steps = append(steps, m.step(parent.child(byBucket[b]), ModeExclusive, true))
+	}
+	claim.Handle = &LockHandle{conn: conn, tx: tx, m: m, steps: steps}
+	claim.Handle.scope = &leafScope{parent: parent, children: slices.Sorted(slices.Values(claim.Claimed))}
+	m.holdOrder(ctx, claim.Handle)
+	return claim, nil
+}
+
+// childCandidates maps each candidate child of parent to its bucket, keeping
+// the first ID per bucket, and reports the buckets shared by several IDs.
+func (h *Hierarchy) childCandidates(parent Path, candidates []string) (map[int]string, []BucketCollision) {
+	byBucket := make(map[int]string, len(candidates))
+	shared := map[int][]string{}
+	var order []int
+	for _, r := range candidates {
+		b := h.target(parent.child(r)).bucket
+		first, ok := byBucket[b]
+		if !ok {
+			byBucket[b] = r
+			continue
+		}
+		if first == r {
+			continue // duplicate ID, not a collision
+		}
+		if _, seen := shared[b]; !seen {
+			shared[b] = []string{first}
+			order = append(order, b)
+		}
+		if !slices.Contains(shared[b], r) {
+			shared[b] = append(shared[b], r)
+		}
+	}
+
+	var collisions []BucketCollision
+	for _, b := range order {
+		c := BucketCollision{Level: h.levels[len(parent)].ID, Bucket: b, IDs: shared[b]}
+		for _, id := range shared[b] {
+			c.Targets = append(c.Targets, h.name(parent.child(id)))
+		}
+		collisions = append(collisions, c)
+	}
+	return byBucket, collisions
+}
+
+// claimError wraps a failure of the claim query under parent. The query
+// locks several rows at once and did not fail on any one of them, so the
+// error names parent and no bucket.
+func (h *Hierarchy) claimError(parent Path, err error) error {
+	level := h.levels[len(parent)]
+	return &LockError{Target: h.name(parent), Level: level.ID, LevelName: level.Name, Bucket: -1, Exclusive: true, Cause: err}
+}
+
+func claimBuckets(ctx context.Context, tx *sql.Tx, level Level, byBucket map[int]string, limit int) ([]int, error) {
+	buckets := make([]int, 0, len(byBucket))
+	for b := range byBucket {
+		buckets = append(buckets, b)
+	}
+	sort.Ints(buckets)
+
+	args := make([]any, 0, len(buckets)+2)
+	args = append(args, int(level))
+	for _, b := range buckets {
+		args = append(args, b)
+	}
+	args = append(args, limit)
+	query := "SELECT bucket FROM hier_lock_buckets WHERE level = ? AND bucket IN (" +
+		strings.TrimSuffix(strings.Repeat("?,", len(buckets)), ",") +
+		") ORDER BY bucket LIMIT ? FOR UPDATE SKIP LOCKED"
+
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var claimed []int
+	for rows.Next() {
+		var b int
+		if err := rows.Scan(&b); err != nil {
+			return nil, err
+		}
+		claimed = append(claimed, b)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return claimed, nil
+}
@@ -0,0 +1,147 @@
+package hierlock
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestClaimResources_DisjointWorkers(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	setupLockTable(ctx, t, db)
+
+	candidates := []string{"r1"}
+	for len(candidates) < 4 {
+		candidates = append(candidates, pickDifferentResourceID("u1", "a1", candidates[len(candidates)-1]))
+	}
+	seedBuckets(ctx, t, db, userTarget("u1"), accountTarget("u1", "a1"))
+	for _, r := range candidates {
+		seedBuckets(ctx, t, db, resourceTarget("u1", "a1", r))
+	}
+
+	m := NewManager(db)
+
+	first, err := m.ClaimResources(ctx, "u1", "a1", candidates, 2)
+	if err != nil {
+		t.Fatalf("first ClaimResources: %v", err)
+	}
+	defer first.Release()
+	if len(first.Claimed) != 2 {
+		t.Fatalf("first claimed %v, want 2 resources", first.Claimed)
+	}
+
+	// The second worker must not wait for the first and must get the rest.
+	start := time.Now()
+	second, err := m.ClaimResources(ctx, "u1", "a1", candidates, len(candidates))
+	if err != nil {
+		t.Fatalf("second ClaimResources: %v", err)
+	}
+	defer second.Release()
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("second ClaimResources should skip locked rows, took %v", d)
+	}
+	if len(second.Claimed) != 2 {
+		t.Fatalf("second claimed %v, want the remaining 2 resources", second.Claimed)
+	}
+	for _, r := range second.Claimed {
+		for _, taken := range first.Claimed {
+			if r == taken {
+				t.Fatalf("resource %s claimed by both workers", r)
+			}
+		}
+	}
+
+	// Nothing left: the third worker gets an empty claim without a handle.
+	third, err := m.ClaimResources(ctx, "u1", "a1", candidates, len(candidates))
+	if err != nil {
+		t.Fatalf("third ClaimResources: %v", err)
+	}
+	if third.Handle != nil || len(third.Claimed) != 0 {
+		t.Fatalf("expected empty claim, got %v", third.Claimed)
+	}
+}
+
+func TestClaimResources_ReportsCollisions(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	setupLockTable(ctx, t, db)
+
+	x, y := findCollidingResourceIDs("u1", "a1")
+	seedBuckets(ctx, t, db, mustTargets(LevelResource, "u1", "a1", x)...)
+
+	m := NewManager(db)
+
+	claim, err := m.ClaimResources(ctx, "u1", "a1", []string{x, y}, 2)
+	if err != nil {
+		t.Fatalf("ClaimResources: %v", err)
+	}
+	defer claim.Release()
+
+	if len(claim.Claimed) != 1 || claim.Claimed[0] != x {
+		t.Fatalf("claimed %v, want only %s", claim.Claimed, x)
+	}
+	if len(claim.Collisions) != 1 {
+		t.Fatalf("collisions %v, want one group", claim.Collisions)
+	}
+}
+
+func TestResourceCandidates_GroupsCollisions(t *testing.T) {
+	x, y := findCollidingResourceIDs("u1", "a1")
+	z := pickDifferentResourceID("u1", "a1", x)
+
+	byBucket, collisions := defaultHierarchy.childCandidates(Path{"u1", "a1"}, []string{x, z, y, x})
+	if len(byBucket) != 2 {
+		t.Fatalf("expected 2 buckets, got %d", len(byBucket))
+	}
+	if got := byBucket[resourceTarget("u1", "a1", x).bucket]; got != x {
+		t.Fatalf("bucket keeps %q, want first candidate %q", got, x)
+	}
+	if len(collisions) != 1 {
+		t.Fatalf("expected one collision group, got %v", collisions)
+	}
+	c := collisions[0]
+	if c.Level != LevelResource || c.Bucket != resourceTarget("u1", "a1", x).bucket {
+		t.Fatalf("unexpected collision target: %+v", c)
+	}
+	if len(c.IDs) != 2 || c.IDs[0] != x || c.IDs[1] != y {
+		t.Fatalf("collision IDs = %v, want [%s %s]", c.IDs, x, y)
+	}
+}
+
+func TestClaimError_NamesParent(t *testing.T) {
+	err := defaultHierarchy.claimError(Path{"u1", "a1"}, &mysql.MySQLError{Number: errLockDeadlock})
+	var le *LockError
+	if !errors.Is(err, ErrDeadlock) || !errors.As(err, &le) {
+		t.Fatalf("expected a *LockError matching ErrDeadlock, got %v", err)
+	}
+	if le.Target != "Account(u1/a1)" || le.Level != LevelResource || le.Bucket != -1 || !le.Exclusive {
+		t.Fatalf("claim error = %+v, want Resource rows under Account(u1/a1) with no bucket", le)
+	}
+	if want := "lock Resource rows under Account(u1/a1) (exclusive=true): "; !strings.HasPrefix(err.Error(), want) {
+		t.Fatalf("Error() = %q, want prefix %q", err.Error(), want)
+	}
+
+	h, err := NewHierarchy(
+		HierarchyLevel{ID: 10, Name: "Org"},
+		HierarchyLevel{ID: 11, Name: "Project"},
+		HierarchyLevel{ID: 12, Name: "Env"},
+	)
+	if err != nil {
+		t.Fatalf("NewHierarchy: %v", err)
+	}
+	err = h.claimError(Path{"o", "p"}, &mysql.MySQLError{Number: errLockDeadlock})
+	if want := "lock Env rows under Project(o/p) (exclusive=true): "; !strings.HasPrefix(err.Error(), want) {
+		t.Fatalf("Error() = %q, want prefix %q", err.Error(), want)
+	}
+}
@@ -68,6 +68,71 @@ func TestHierarchy_Deadlock_UnorderedMultiResource(t *testing.T) {
 	}
 }
 
+// With retry, the same unordered workload eventually completes: the deadlock
+// victim is rolled back, waits, and runs again in a fresh transaction.
+func TestHierarchy_UnorderedMultiResourceCompletesUnderRetry(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	setupLockTable(ctx, t, db)
+	r2 := pickDifferentResourceID("u1", "a1", "r1")
+	seedBuckets(ctx, t, db,
+		userTarget("u1"),
+		accountTarget("u1", "a1"),
+		resourceTarget("u1", "a1", "r1"),
+		resourceTarget("u1", "a1", r2),
+	)
+
+	ready1 := make(chan struct{})
+	ready2 := make(chan struct{})
+	startSecond := make(chan struct{})
+	attemptsCh := make(chan int, 2)
+
+	policy := DefaultRetryPolicy()
+	policy.MaxAttempts = 10
+	policy.OnDone = func(attempts int, err error) { attemptsCh <- attempts }
+
+	run := func(first, second string, ready chan<- struct{}) error {
+		attempt := 0
+		return policy.Do(ctx, func(ctx context.Context) error {
+			attempt++
+			if attempt == 1 {
+				// Force the deadlock on the first attempt.
+				return acquireTwoResourcesUnorderedWithBarrier(ctx, db, "u1", "a1", first, second, ready, startSecond)
+			}
+			return acquireTwoResourcesUnorderedWithBarrier(ctx, db, "u1", "a1", first, second, nil, nil)
+		})
+	}
+
+	resCh := make(chan error, 2)
+	go func() { resCh <- run("r1", r2, ready1) }()
+	go func() { resCh <- run(r2, "r1", ready2) }()
+
+	for _, ready := range []chan struct{}{ready1, ready2} {
+		select {
+		case <-ready:
+		case err := <-resCh:
+			t.Fatalf("workload failed before its first lock: %v", err)
+		case <-time.After(3 * time.Second):
+			t.Fatalf("timed out waiting for both transactions to lock their first resource")
+		}
+	}
+	close(startSecond)
+
+	for i := 0; i < 2; i++ {
+		if err := <-resCh; err != nil {
+			t.Fatalf("unordered workload under retry failed: %v", err)
+		}
+	}
+	total := <-attemptsCh + <-attemptsCh
+	if total < 3 {
+		t.Fatalf("expected at least one retry after the forced deadlock, got %d attempts", total)
+	}
+}
+
 func acquireTwoResourcesUnorderedWithBarrier(
 	ctx context.Context,
 	db *sql.DB,
@@ -98,8 +163,10 @@ func acquireTwoResourcesUnorderedWithBarrier(
 		return err
 	}
 
-	close(ready)
-	<-startSecond
+	if ready != nil {
+		close(ready)
+		<-startSecond
+	}
 
 	// This lock attempt should create a deadlock against the other transaction.
 	if err := lockRow(ctx, tx, resourceTarget(userID, accountID, secondResourceID), true); err != nil {
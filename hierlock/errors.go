@@ -0,0 +1,127 @@
+package hierlock
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// MySQL server error numbers that hierlock classifies.
+const (
+	errLockWaitTimeout  = 1205 // ER_LOCK_WAIT_TIMEOUT
+	errLockDeadlock     = 1213 // ER_LOCK_DEADLOCK
+	errLockNoWait       = 3572 // ER_LOCK_NOWAIT
+	errUserLockDeadlock = 3058 // ER_USER_LOCK_DEADLOCK (GET_LOCK)
+)
+
+// Sentinel errors returned by hierlock. They are matched with errors.Is and
+// are never returned bare for lock failures: those come wrapped in a *LockError
+// that names the target.
+var (
+	// ErrWouldBlock is returned by the TryAcquire family when a lock is held
+	// by another transaction (MySQL error 3572).
+	ErrWouldBlock = errors.New("hierlock: lock would block")
+
+	// ErrLockWaitTimeout matches lock statements that hit
+	// innodb_lock_wait_timeout (MySQL error 1205).
+	ErrLockWaitTimeout = errors.New("hierlock: lock wait timeout")
+
+	// ErrDeadlock matches lock statements chosen as the deadlock victim
+	// (MySQL error 1213). The whole lock transaction has been rolled back.
+	// For NamedLocker it matches GET_LOCK deadlocks (MySQL error 3058).
+	ErrDeadlock = errors.New("hierlock: deadlock")
+
+	// ErrBucketNotProvisioned matches lock statements whose (level, bucket)
+	// row does not exist in hier_lock_buckets.
+	ErrBucketNotProvisioned = errors.New("hierlock: bucket not provisioned")
+
+	// ErrInvalidArgument wraps validation failures such as missing IDs.
+	ErrInvalidArgument = errors.New("hierlock: invalid argument")
+
+	// ErrManagerClosed is returned by acquisitions on a closed Manager.
+	ErrManagerClosed = errors.New("hierlock: manager closed")
+
+	// ErrLockOrderViolation is returned when adding a lock to a held handle
+	// would break the total acquisition order that keeps hierlock
+	// deadlock-free. The handle still holds its previous locks.
+	ErrLockOrderViolation = errors.New("hierlock: lock order violation")
+
+	// ErrDied is returned under WaitDie when a younger transaction met an
+	// older holder and gave way. Acquisitions restart on their own; it only
+	// reaches callers from Upgrade and AddResources, whose handle should then
+	// be released.
+	ErrDied = errors.New("hierlock: transaction died (wait-die)")
+
+	// ErrWounded is returned under WoundWait when an older transaction asked
+	// this one to give way. Like ErrDied, only Upgrade and AddResources
+	// return it.
+	ErrWounded = errors.New("hierlock: transaction wounded (wound-wait)")
+)
+
+// LockError reports a failure to lock a single (level, bucket) row.
+type LockError struct {
+	// Target names the hierarchy node, e.g. "Account(u1/a1)". It may be empty
+	// when the row was locked without a known path.
+	Target string
+	Level  Level
+	// LevelName is the hierarchy's name for Level, e.g. "Resource". It may
+	// be empty, in which case Error falls back to the built-in level names.
+	LevelName string
+	// Bucket is -1 when one statement locked several rows of Level and failed
+	// as a whole, like the claim query of ClaimResources; Target then names
+	// their parent.
+	Bucket    int
+	Exclusive bool
+	Cause     error
+}
+
+func (e *LockError) Error() string {
+	if e.Bucket < 0 {
+		name := e.LevelName
+		if name == "" {
+			name = e.Level.String()
+		}
+		return fmt.Sprintf("lock %s rows under %s (exclusive=%v): %v", name, e.Target, e.Exclusive, e.Cause)
+	}
+	if e.Target == "" {
+		return fmt.Sprintf("lock level=%d bucket=%d (exclusive=%v): %v", e.Level, e.Bucket, e.Exclusive, e.Cause)
+	}
+	return fmt.Sprintf("lock %s level=%d bucket=%d (exclusive=%v): %v", e.Target, e.Level, e.Bucket, e.Exclusive, e.Cause)
+}
+
+func (e *LockError) Unwrap() error {
+	return e.Cause
+}
+
+// Is classifies the underlying error so that callers can use errors.Is with
+// ErrWouldBlock, ErrLockWaitTimeout, ErrDeadlock and ErrBucketNotProvisioned.
+func (e *LockError) Is(target error) bool {
+	switch target {
+	case ErrWouldBlock:
+		return mysqlErrorNumber(e.Cause) == errLockNoWait
+	case ErrLockWaitTimeout:
+		return mysqlErrorNumber(e.Cause) == errLockWaitTimeout
+	case ErrDeadlock:
+		n := mysqlErrorNumber(e.Cause)
+		return n == errLockDeadlock || n == errUserLockDeadlock
+	case ErrBucketNotProvisioned:
+		return errors.Is(e.Cause, sql.ErrNoRows)
+	default:
+		return false
+	}
+}
+
+func invalidArgf(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrInvalidArgument, fmt.Sprintf(format, args...))
+}
+
+// mysqlErrorNumber returns the server error number in err's chain, or 0.
+func mysqlErrorNumber(err error) uint16 {
+	var me *mysql.MySQLError
+	if !errors.As(err, &me) {
+		return 0
+	}
+	return me.Number
+}
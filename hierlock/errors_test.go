@@ -0,0 +1,105 @@
+package hierlock
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestLockError_Classification(t *testing.T) {
+	sentinels := []error{ErrWouldBlock, ErrLockWaitTimeout, ErrDeadlock, ErrBucketNotProvisioned}
+	cases := []struct {
+		name  string
+		cause error
+		want  error
+	}{
+		{name: "nowait", cause: &mysql.MySQLError{Number: errLockNoWait}, want: ErrWouldBlock},
+		{name: "lock wait timeout", cause: &mysql.MySQLError{Number: errLockWaitTimeout}, want: ErrLockWaitTimeout},
+		{name: "deadlock", cause: &mysql.MySQLError{Number: errLockDeadlock}, want: ErrDeadlock},
+		{name: "missing bucket row", cause: sql.ErrNoRows, want: ErrBucketNotProvisioned},
+		{name: "other", cause: &mysql.MySQLError{Number: 1064}, want: nil},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			le := &LockError{Target: "Account(u1/a1)", Level: LevelAccount, Bucket: 42, Exclusive: true, Cause: tc.cause}
+			wrapped := fmt.Errorf("acquire: %w", le)
+
+			for _, s := range sentinels {
+				if got := errors.Is(wrapped, s); got != (s == tc.want) {
+					t.Fatalf("errors.Is(%v) = %v, want %v", s, got, s == tc.want)
+				}
+			}
+			var got *LockError
+			if !errors.As(wrapped, &got) || got.Target != "Account(u1/a1)" {
+				t.Fatalf("expected *LockError with target through wrapping, got %v", got)
+			}
+			if !errors.Is(wrapped, tc.cause) {
+				t.Fatalf("expected the cause to stay reachable")
+			}
+		})
+	}
+}
+
+func TestManager_ArgumentAndClosedErrors(t *testing.T) {
+	// sql.Open does not connect, so these checks run without MySQL.
+	db, err := sql.Open("mysql", "invalid:invalid@tcp(127.0.0.1:1)/none")
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	m := NewManager(db)
+
+	if _, err := m.Acquire(ctx, LevelAccount, "u1", "", ""); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("missing accountID: expected ErrInvalidArgument, got %v", err)
+	}
+	if _, err := m.AcquireResources(ctx, "u1", "a1", nil); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("missing resourceIDs: expected ErrInvalidArgument, got %v", err)
+	}
+	if _, err := m.Acquire(ctx, Level(99), "u1", "a1", "r1"); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("unknown level: expected ErrInvalidArgument, got %v", err)
+	}
+	if _, err := m.Acquire(ctx, LevelUser, "u1", "", "", WithLockWaitTimeout(-time.Second)); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("negative timeout: expected ErrInvalidArgument, got %v", err)
+	}
+	if _, err := NewManager(nil).Acquire(ctx, LevelUser, "u1", "", ""); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("nil db: expected ErrInvalidArgument, got %v", err)
+	}
+
+	_ = m.Close()
+	if _, err := m.Acquire(ctx, LevelUser, "u1", "", ""); !errors.Is(err, ErrManagerClosed) {
+		t.Fatalf("closed manager: expected ErrManagerClosed, got %v", err)
+	}
+	if _, err := m.ClaimResources(ctx, "u1", "a1", []string{"r1"}, 1); !errors.Is(err, ErrManagerClosed) {
+		t.Fatalf("closed manager claim: expected ErrManagerClosed, got %v", err)
+	}
+}
+
+func TestAcquire_BucketNotProvisioned(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	setupLockTable(ctx, t, db)
+	// Only the ancestors are provisioned.
+	seedBuckets(ctx, t, db, mustTargets(LevelAccount, "u1", "a1", "")...)
+
+	m := NewManager(db)
+
+	_, err := m.Acquire(ctx, LevelResource, "u1", "a1", "r1")
+	if !errors.Is(err, ErrBucketNotProvisioned) {
+		t.Fatalf("expected ErrBucketNotProvisioned, got: %v", err)
+	}
+	var le *LockError
+	if !errors.As(err, &le) || le.Target != "Resource(u1/a1/r1)" || le.Level != LevelResource {
+		t.Fatalf("expected LockError for Resource(u1/a1/r1), got: %v", err)
+	}
+}
@@ -0,0 +1,118 @@
+package hierlock
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestManager_EscalationDecision(t *testing.T) {
+	var events []EscalationEvent
+	m := NewManager(nil, WithEscalation(2), WithEscalationHook(func(e EscalationEvent) {
+		events = append(events, e)
+	}))
+
+	cases := []struct {
+		name string
+		n    int
+		opts []AcquireOption
+		want bool
+	}{
+		{name: "at threshold", n: 2, want: false},
+		{name: "above threshold", n: 3, want: true},
+		{name: "per-call threshold", n: 3, opts: []AcquireOption{WithEscalationThreshold(5)}, want: false},
+		{name: "per-call disable", n: 100, opts: []AcquireOption{WithEscalationThreshold(0)}, want: false},
+	}
+	for _, tc := range cases {
+		cfg, err := newAcquireConfig(tc.opts)
+		if err != nil {
+			t.Fatalf("%s: newAcquireConfig: %v", tc.name, err)
+		}
+		if got := m.escalate(Path{"u1", "a1"}, tc.n, cfg); got != tc.want {
+			t.Fatalf("%s: escalate(%d) = %v, want %v", tc.name, tc.n, got, tc.want)
+		}
+	}
+
+	// The disabled call is not reported; the others are.
+	if len(events) != 3 {
+		t.Fatalf("hook saw %d events, want 3: %+v", len(events), events)
+	}
+	if e := events[1]; !e.Escalated || e.Resources != 3 || e.Threshold != 2 || e.AccountID != "a1" {
+		t.Fatalf("unexpected event: %+v", e)
+	}
+
+	// A custom hierarchy's leaf parent at depth 2 is not an Account.
+	h, err := NewHierarchy(
+		HierarchyLevel{ID: 10, Name: "Org"},
+		HierarchyLevel{ID: 11, Name: "Team"},
+		HierarchyLevel{ID: 12, Name: "Doc"},
+	)
+	if err != nil {
+		t.Fatalf("NewHierarchy: %v", err)
+	}
+	var custom []EscalationEvent
+	cm := NewManager(nil, WithHierarchy(h), WithEscalation(2), WithEscalationHook(func(e EscalationEvent) {
+		custom = append(custom, e)
+	}))
+	cm.escalate(Path{"o1", "t1"}, 3, acquireConfig{})
+	if len(custom) != 1 || custom[0].UserID != "" || custom[0].AccountID != "" || len(custom[0].Parent) != 2 {
+		t.Fatalf("custom hierarchy event: %+v", custom)
+	}
+
+	if NewManager(nil).escalate(Path{"u1", "a1"}, 1000, acquireConfig{}) {
+		t.Fatalf("escalation must be off by default")
+	}
+}
+
+func TestAcquireResources_EscalatesToAccount(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	setupLockTable(ctx, t, db)
+
+	a2 := pickDifferentAccountIDNonCollidingResource("u1", "a1", "r1")
+	seedBuckets(ctx, t, db, mustTargets(LevelResource, "u1", "a1", "r1")...)
+	seedBuckets(ctx, t, db, mustTargets(LevelResource, "u1", a2, "r1")...)
+
+	m := NewManager(db, WithEscalation(2))
+
+	// r2, r3 are never provisioned: an escalated acquisition does not touch them.
+	h, err := m.AcquireResources(ctx, "u1", "a1", []string{"r1", "r2", "r3"})
+	if err != nil {
+		t.Fatalf("AcquireResources: %v", err)
+	}
+	defer h.Release()
+	if !h.Escalated() {
+		t.Fatalf("expected escalation above the threshold")
+	}
+	held := heldTargets(h)
+	if held["Account(u1/a1)"] != ModeExclusive || len(held) != 2 {
+		t.Fatalf("expected User(S) + Account(X) only, got %+v", held)
+	}
+
+	if _, err := m.TryAcquire(ctx, LevelResource, "u1", "a1", "r1"); !errors.Is(err, ErrWouldBlock) {
+		t.Fatalf("expected resources under the escalated account to be locked, got: %v", err)
+	}
+	other, err := m.TryAcquire(ctx, LevelResource, "u1", a2, "r1")
+	if err != nil {
+		t.Fatalf("sibling account must stay available: %v", err)
+	}
+	_ = other.Release()
+
+	// Escalation already covers any resource of the account.
+	if err := h.AddResources(ctx, "r0"); err != nil {
+		t.Fatalf("AddResources on escalated handle: %v", err)
+	}
+
+	below, err := m.AcquireResources(ctx, "u1", a2, []string{"r1"})
+	if err != nil {
+		t.Fatalf("AcquireResources below threshold: %v", err)
+	}
+	defer below.Release()
+	if below.Escalated() {
+		t.Fatalf("did not expect escalation below the threshold")
+	}
+}
@@ -0,0 +1,57 @@
+package hierlock
+
+import (
+	"context"
+)
+
+// globalTarget is the single row of LevelGlobal.
+var globalTarget = lockTarget{level: LevelGlobal, bucket: 0}
+
+func globalStep(mode LockMode, requested bool) lockStep {
+	return lockStep{target: globalTarget, mode: mode, requested: requested, name: "Global"}
+}
+
+// withGlobal prepends the Global row in mode when the manager uses
+// WithGlobalLock.
+func (m *Manager) withGlobal(steps []lockStep, mode LockMode) []lockStep {
+	if !m.global {
+		return steps
+	}
+	return append([]lockStep{globalStep(mode, false)}, steps...)
+}
+
+// AcquireGlobal locks the Global row exclusively (or in the WithMode mode),
+// for maintenance such as a migration. It waits for every acquisition in
+// progress on a WithGlobalLock manager to be released and blocks new ones
+// until the handle is released.
+//
+// It fails with ErrInvalidArgument unless the manager uses WithGlobalLock.
+func (m *Manager) AcquireGlobal(ctx context.Context, opts ...AcquireOption) (*LockHandle, error) {
+	cfg, err := newAcquireConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	return m.acquireGlobal(ctx, cfg)
+}
+
+// TryAcquireGlobal is the NOWAIT variant of AcquireGlobal. See TryAcquire.
+func (m *Manager) TryAcquireGlobal(ctx context.Context, opts ...AcquireOption) (*LockHandle, error) {
+	cfg, err := newAcquireConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	cfg.wait = waitNoWait
+	return m.acquireGlobal(ctx, cfg)
+}
+
+func (m *Manager) acquireGlobal(ctx context.Context, cfg acquireConfig) (*LockHandle, error) {
+	if err := m.check(); err != nil {
+		return nil, err
+	}
+	if !m.global {
+		return nil, invalidArgf("global lock is not enabled (WithGlobalLock)")
+	}
+	steps := []lockStep{globalStep(cfg.mode, true)}
+	m.assignSlots(steps, m.nextSlot())
+	return m.acquireSteps(ctx, steps, cfg)
+}
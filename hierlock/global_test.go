@@ -0,0 +1,109 @@
+package hierlock
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestGlobalLock_PrependedOnlyWhenEnabled(t *testing.T) {
+	steps, err := NewManager(nil).pathSteps(Path{"u1", "a1"}, ModeExclusive)
+	if err != nil {
+		t.Fatalf("pathSteps: %v", err)
+	}
+	if steps[0].target.level == LevelGlobal {
+		t.Fatalf("Global must be off by default: %+v", steps)
+	}
+
+	m := NewManager(nil, WithGlobalLock())
+	steps, err = m.pathSteps(Path{"u1", "a1"}, ModeExclusive)
+	if err != nil {
+		t.Fatalf("pathSteps: %v", err)
+	}
+	if len(steps) != 3 || steps[0].target != globalTarget || steps[0].mode != ModeShared || steps[0].requested {
+		t.Fatalf("expected a shared Global step first: %+v", steps)
+	}
+
+	// Merged once in AcquireSet, ahead of every level.
+	set, err := m.setSteps([]LockRequest{
+		{Level: LevelUser, UserID: "u1"},
+		{Level: LevelUser, UserID: "u2"},
+	})
+	if err != nil {
+		t.Fatalf("setSteps: %v", err)
+	}
+	planned, _ := planSteps(set)
+	if len(planned) != 3 || planned[0].target != globalTarget {
+		t.Fatalf("plan = %+v", planned)
+	}
+}
+
+func TestAcquireGlobal_RequiresOptIn(t *testing.T) {
+	// sql.Open does not connect, so this runs without MySQL.
+	db, err := sql.Open("mysql", "invalid:invalid@tcp(127.0.0.1:1)/none")
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	defer db.Close()
+
+	if _, err := NewManager(db).AcquireGlobal(context.Background()); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("expected ErrInvalidArgument, got %v", err)
+	}
+}
+
+func TestAcquireGlobal_DrainsAndBlocksHierarchy(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	setupLockTable(ctx, t, db)
+	seedBuckets(ctx, t, db, globalTarget)
+	seedBuckets(ctx, t, db, mustTargets(LevelResource, "u1", "a1", "r1")...)
+
+	m := NewManager(db, WithGlobalLock())
+
+	// An operation in progress keeps the admin out.
+	worker, err := m.Acquire(ctx, LevelResource, "u1", "a1", "r1")
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	if h, err := m.TryAcquireGlobal(ctx); !errors.Is(err, ErrWouldBlock) {
+		if err == nil {
+			_ = h.Release()
+		}
+		t.Fatalf("expected the admin to wait for the worker, got %v", err)
+	}
+
+	// Once drained, the admin blocks every new operation.
+	done := make(chan error, 1)
+	var admin *LockHandle
+	go func() {
+		var err error
+		admin, err = m.AcquireGlobal(ctx)
+		done <- err
+	}()
+	time.Sleep(200 * time.Millisecond)
+	_ = worker.Release()
+	if err := <-done; err != nil {
+		t.Fatalf("AcquireGlobal: %v", err)
+	}
+
+	_, err = m.TryAcquire(ctx, LevelUser, "u1", "", "", WithMode(ModeShared))
+	var le *LockError
+	if !errors.Is(err, ErrWouldBlock) || !errors.As(err, &le) || le.Level != LevelGlobal {
+		t.Fatalf("expected ErrWouldBlock on Global, got %v", err)
+	}
+	if _, err := m.TryAcquireResources(ctx, "u1", "a1", []string{"r1"}); !errors.Is(err, ErrWouldBlock) {
+		t.Fatalf("expected AcquireResources to be blocked, got %v", err)
+	}
+
+	_ = admin.Release()
+	h, err := m.TryAcquire(ctx, LevelResource, "u1", "a1", "r1")
+	if err != nil {
+		t.Fatalf("after the admin released: %v", err)
+	}
+	_ = h.Release()
+}
@@ -0,0 +1,363 @@
+package hierlock
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+)
+
+type LockHandle struct {
+	tx *sql.Tx
+	// conn is the connection tx runs on, nil when borrowed. It is discarded
+	// on release if resetFailed is set.
+	conn        *sql.Conn
+	resetFailed bool
+	// borrowed is set when tx belongs to the caller (AcquireInTx); the locks
+	// then end with the caller's commit or rollback.
+	borrowed bool
+
+	m     *Manager
+	steps []lockStep // rows held, in acquisition order, with their current mode
+	cfg   acquireConfig
+	scope *leafScope // set when the handle holds a leaf's parent and may add leaves
+
+	collisions []BucketCollision
+
+	orderScope any // the WithLockOrderValidator scope holding the handle
+}
+
+// leafScope records the parent of the leaf level a handle holds (the Account
+// in the default hierarchy) and the leaves it has locked under it, in
+// acquisition order.
+type leafScope struct {
+	parent   Path
+	children []string
+	// escalated is set when the parent is held exclusively in place of the
+	// individual leaves.
+	escalated bool
+}
+
+// scopeFor returns the scope of a handle that locked the node at path, or
+// nil if the node is neither a leaf nor a leaf's parent.
+func (h *Hierarchy) scopeFor(path Path) *leafScope {
+	switch len(path) {
+	case h.Depth() - 1:
+		return &leafScope{parent: path}
+	case h.Depth():
+		return &leafScope{parent: path[:len(path)-1], children: []string{path[len(path)-1]}}
+	default:
+		return nil
+	}
+}
+
+// HeldLock describes one row lock held by a LockHandle.
+type HeldLock struct {
+	Target string // e.g. "Account(u1/a1)"
+	Level  Level
+	Bucket int
+	Mode   LockMode
+	// Requested is false for ancestors taken implicitly.
+	Requested bool
+}
+
+// Release releases all row locks by rolling back the underlying transaction.
+// (We intentionally rollback because this is a pure lock acquisition transaction.)
+// For handles returned by AcquireInTx, Release is a no-op.
+func (h *LockHandle) Release() error {
+	if h == nil || h.tx == nil || h.borrowed {
+		return nil
+	}
+	err := h.tx.Rollback()
+	h.closeConn()
+	h.untrack()
+	return err
+}
+
+// adopt makes h hold the locks of nh, a handle acquired to replace h's
+// released ones.
+func (h *LockHandle) adopt(nh *LockHandle) {
+	h.tx, h.conn, h.resetFailed, h.steps, h.cfg = nh.tx, nh.conn, nh.resetFailed, nh.steps, nh.cfg
+	if scope := nh.orderScope; scope != nil {
+		h.m.releaseOrder(nh)
+		h.orderScope = scope
+		h.m.holdOrder(context.Background(), h)
+	}
+}
+
+// lockSteps locks steps inside the held transaction, noting whether the
+// connection must be discarded on release.
+func (h *LockHandle) lockSteps(ctx context.Context, steps []lockStep) error {
+	err := lockSteps(ctx, h.tx, steps, h.cfg)
+	if errors.Is(err, errLockWaitNotReset) {
+		h.resetFailed = true
+	}
+	return err
+}
+
+// closeConn returns the handle's connection to the pool once its transaction
+// has ended.
+func (h *LockHandle) closeConn() {
+	closeLockConn(h.conn, h.resetFailed)
+	h.conn = nil
+}
+
+// untrack forgets the handle in the manager's deadlock and lock order
+// bookkeeping once its transaction has ended.
+func (h *LockHandle) untrack() {
+	h.cfg.txn.end()
+	h.m.releaseOrder(h)
+}
+
+// Escalated reports whether AcquireResources locked the Account exclusively
+// instead of the individual resources.
+func (h *LockHandle) Escalated() bool {
+	return h != nil && h.scope != nil && h.scope.escalated
+}
+
+// Collisions reports requested targets that share a (level, bucket) row
+// and are therefore held by one row lock, in lock order.
+func (h *LockHandle) Collisions() []BucketCollision {
+	if h == nil {
+		return nil
+	}
+	return h.collisions
+}
+
+// Held returns the row locks held by the handle and the mode of each.
+func (h *LockHandle) Held() []HeldLock {
+	if h == nil {
+		return nil
+	}
+	held := make([]HeldLock, 0, len(h.steps))
+	for _, st := range h.steps {
+		held = append(held, HeldLock{Target: st.name, Level: st.target.level, Bucket: st.target.bucket, Mode: st.mode, Requested: st.requested})
+	}
+	return held
+}
+
+// Upgrade converts every requested target held in a weaker mode (such as
+// ModeShared) to ModeExclusive by re-issuing FOR UPDATE on its bucket inside
+// the held transaction. Ancestors stay shared; with intention locks,
+// ancestors held IS are raised to IX first.
+//
+// Two holders of the same shared target that both upgrade wait for each
+// other; MySQL picks one as the deadlock victim and that Upgrade fails with
+// ErrDeadlock. The victim's transaction has been rolled back, so its handle
+// holds nothing and should only be released. Under WithDeadlockDetection the
+// one that would close the cycle fails with a *DeadlockError before MySQL
+// notices; it still holds its locks and should be released. Under
+// WithDeadlockPrevention one of them fails with ErrDied or ErrWounded
+// instead and should be released to let the other proceed. Other failures
+// (for example ErrLockWaitTimeout) are not undone: targets upgraded before
+// the failing one stay exclusive, the rest keep their previous modes, and
+// Held reports which is which.
+//
+// On a handle from TryAcquire (or another Try method) Upgrade does not wait
+// either: it fails with ErrWouldBlock if a row is locked by another
+// transaction.
+func (h *LockHandle) Upgrade(ctx context.Context) error {
+	if h == nil || h.tx == nil {
+		return invalidArgf("lock handle is nil")
+	}
+	for i, st := range h.steps {
+		up := st
+		switch {
+		case st.requested && st.mode != ModeExclusive:
+			up.mode = ModeExclusive
+		case !st.requested && st.mode == ModeIntentShared:
+			up.mode = ModeIntentExclusive
+		default:
+			continue
+		}
+		if err := h.lockSteps(ctx, []lockStep{up}); err != nil {
+			return err
+		}
+		h.steps[i] = up
+	}
+	return nil
+}
+
+// Downgrade converts every requested target held in ModeExclusive back to
+// ModeShared.
+//
+// InnoDB cannot weaken a row lock inside a transaction, so Downgrade releases
+// the handle and acquires the same rows again in a new transaction with the
+// targets shared. This is NOT atomic: another transaction may lock the
+// targets in between. Callers that need to keep the data stable across the
+// switch should keep the exclusive lock instead. On error the handle holds
+// nothing. Handles from AcquireInTx and escalated handles cannot be
+// downgraded. Under WithDeadlockPrevention the new transaction keeps the
+// handle's timestamp, so the handle does not lose its age.
+func (h *LockHandle) Downgrade(ctx context.Context) error {
+	if h == nil || h.tx == nil {
+		return invalidArgf("lock handle is nil")
+	}
+	if h.borrowed {
+		return invalidArgf("cannot downgrade a lock held in the caller's transaction")
+	}
+	if h.Escalated() {
+		// A shared Account would no longer exclude writers of the resources.
+		return invalidArgf("cannot downgrade an escalated lock")
+	}
+	steps := make([]lockStep, len(h.steps))
+	changed := false
+	for i, st := range h.steps {
+		if st.requested && st.mode == ModeExclusive {
+			st.mode = ModeShared
+			changed = true
+		}
+		steps[i] = st
+	}
+	if !changed {
+		return nil
+	}
+
+	relErr := h.Release()
+	h.tx = nil
+	nh, err := h.m.acquireSteps(ctx, steps, h.cfg)
+	if err != nil {
+		return errors.Join(relErr, err)
+	}
+	h.adopt(nh)
+	return nil
+}
+
+// AddResources locks more resources under the handle's Account, in the
+// handle's target mode, inside the held transaction. The handle must hold an
+// Account, i.e. come from AcquireResources, ClaimResources, or Acquire at
+// LevelAccount or LevelResource. With a custom hierarchy, resources are the
+// leaf level and the handle must hold their parent.
+//
+// To keep the deadlock-free guarantee, the rows of new resources must come
+// after every row already held in (level, bucket) order, the order
+// AcquireResources uses. Otherwise AddResources fails with
+// ErrLockOrderViolation and the handle keeps what it held, unless the handle
+// was acquired with WithRestartOnOrderViolation: then the handle is released
+// and everything is acquired again, in order, in a new transaction. Other
+// transactions may lock the old resources during the restart; if the restart
+// fails the handle holds nothing. Under WithDeadlockPrevention the order
+// does not matter: the rows are locked anyway, and AddResources may fail
+// with ErrDied or ErrWounded instead, in which case the handle should be
+// released. WithDeadlockDetection does not lift the order, since it cannot
+// see deadlocks with other processes.
+//
+// IDs the handle already holds are ignored. On an escalated handle the
+// exclusive Account already covers every resource, so nothing is locked.
+// On a handle from a Try method the new rows are locked with NOWAIT too,
+// and AddResources fails with ErrWouldBlock instead of waiting.
+func (h *LockHandle) AddResources(ctx context.Context, resourceIDs ...string) error {
+	if h == nil || h.tx == nil {
+		return invalidArgf("lock handle is nil")
+	}
+	if h.scope == nil {
+		return invalidArgf("lock handle does not hold an Account")
+	}
+	added := make([]string, 0, len(resourceIDs))
+	for _, r := range resourceIDs {
+		if r == "" {
+			return invalidArgf("resourceID is required")
+		}
+		if !slices.Contains(h.scope.children, r) && !slices.Contains(added, r) {
+			added = append(added, r)
+		}
+	}
+	if len(added) == 0 {
+		return nil
+	}
+	sort.Strings(added)
+	if h.scope.escalated {
+		h.scope.children = slices.Sorted(slices.Values(append(h.scope.children, added...)))
+		return nil
+	}
+
+	steps := slices.Clone(h.steps)
+	for _, r := range added {
+		steps = append(steps, h.m.step(h.scope.parent.child(r), h.cfg.mode, true))
+	}
+	steps, collisions := planSteps(steps)
+
+	// Rows some added ID maps to but the handle does not hold yet, in lock order.
+	var fresh []lockStep
+	for _, st := range steps {
+		if !slices.ContainsFunc(h.steps, func(held lockStep) bool { return held.target == st.target }) {
+			fresh = append(fresh, st)
+		}
+	}
+	if last := h.steps[len(h.steps)-1]; len(fresh) > 0 && fresh[0].target.less(last.target) && !h.prevented() {
+		if !h.cfg.restartOnOrderViolation || h.borrowed {
+			return fmt.Errorf("%w: %s (bucket %d) sorts before held %s (bucket %d)",
+				ErrLockOrderViolation, fresh[0].name, fresh[0].target.bucket, last.name, last.target.bucket)
+		}
+		return h.restartWithResources(ctx, added)
+	}
+
+	// Record each row as it is locked, so a partial failure leaves the handle
+	// describing what it actually holds.
+	covered := func(target lockTarget) {
+		for _, r := range added {
+			if h.m.h.target(h.scope.parent.child(r)) == target {
+				h.scope.children = append(h.scope.children, r)
+			}
+		}
+	}
+	for _, st := range h.steps {
+		covered(st.target) // IDs sharing a bucket the handle already holds
+	}
+	h.collisions = collisions
+	// Like AcquireInTx, a borrowed handle is not validated: nothing would
+	// forget its rows when the caller's transaction ends.
+	if h.cfg.wait == waitBlock && !h.borrowed {
+		h.m.checkOrder(ctx, fresh)
+	}
+	for _, st := range fresh {
+		if err := h.lockSteps(ctx, []lockStep{st}); err != nil {
+			return err
+		}
+		h.steps = append(h.steps, st)
+		covered(st.target)
+		if !h.borrowed {
+			h.m.holdOrder(ctx, h)
+		}
+	}
+	return nil
+}
+
+// prevented reports whether the handle's rows are locked under deadlock
+// prevention, which resolves conflicts without relying on lock order.
+// Deadlock detection only sees this manager's acquisitions, so it does not
+// exempt a handle from the order.
+func (h *LockHandle) prevented() bool {
+	return h.cfg.txn != nil && h.cfg.txn.reg.policy != 0
+}
+
+// restartWithResources releases the handle and acquires its ancestors and
+// Account plus the union of old and new resources, in order.
+func (h *LockHandle) restartWithResources(ctx context.Context, added []string) error {
+	resources := append(append([]string{}, h.scope.children...), added...)
+	sort.Strings(resources)
+
+	steps := make([]lockStep, 0, len(h.steps)+len(added))
+	for _, st := range h.steps {
+		if st.target.level != h.m.h.leaf() {
+			steps = append(steps, st)
+		}
+	}
+	for _, r := range resources {
+		steps = append(steps, h.m.step(h.scope.parent.child(r), h.cfg.mode, true))
+	}
+	steps, collisions := planSteps(steps)
+
+	relErr := h.Release()
+	h.tx = nil
+	nh, err := h.m.acquireSteps(ctx, steps, h.cfg)
+	if err != nil {
+		return errors.Join(relErr, err)
+	}
+	h.adopt(nh)
+	h.scope.children = resources
+	h.collisions = collisions
+	return nil
+}
@@ -0,0 +1,174 @@
+package hierlock
+
+import (
+	"strings"
+)
+
+// HierarchyLevel names one level of a Hierarchy. ID is the value stored in
+// hier_lock_buckets.level for the level's rows.
+type HierarchyLevel struct {
+	ID   Level
+	Name string
+}
+
+// Hierarchy is an ordered list of levels, from the root down, such as
+// org -> project -> environment -> service.
+//
+// A node is addressed by a Path holding one ID per level from the root.
+// Its bucket is derived from the lowercased level name and the path IDs
+// joined with ":", so the default hierarchy maps User, Account and Resource
+// to the same rows as before.
+type Hierarchy struct {
+	levels   []HierarchyLevel
+	prefixes []string // bucket prefix per level, e.g. "account:"
+}
+
+// Path identifies a hierarchy node by its IDs from the root down; the length
+// of the path selects the level. For the default hierarchy,
+// Path{"u1", "a1"} is Account(u1/a1).
+type Path []string
+
+var defaultHierarchy = mustHierarchy(
+	HierarchyLevel{ID: LevelUser, Name: "User"},
+	HierarchyLevel{ID: LevelAccount, Name: "Account"},
+	HierarchyLevel{ID: LevelResource, Name: "Resource"},
+)
+
+// DefaultHierarchy returns the User -> Account -> Resource hierarchy used by
+// managers created without WithHierarchy.
+func DefaultHierarchy() *Hierarchy {
+	return defaultHierarchy
+}
+
+// NewHierarchy defines a hierarchy from its levels, root first.
+//
+// Level IDs must strictly increase with depth and fit hier_lock_buckets.level
+// (0..127); names must be non-empty and unique ignoring case, since the
+// lowercased name is part of the bucket key.
+func NewHierarchy(levels ...HierarchyLevel) (*Hierarchy, error) {
+	if len(levels) == 0 {
+		return nil, invalidArgf("hierarchy has no levels")
+	}
+	h := &Hierarchy{
+		levels:   append([]HierarchyLevel{}, levels...),
+		prefixes: make([]string, len(levels)),
+	}
+	for i, l := range levels {
+		if l.Name == "" {
+			return nil, invalidArgf("hierarchy level %d has no name", i)
+		}
+		if l.ID < 0 || l.ID > 127 {
+			return nil, invalidArgf("hierarchy level %s has ID %d outside 0..127", l.Name, int(l.ID))
+		}
+		if i > 0 && l.ID <= levels[i-1].ID {
+			return nil, invalidArgf("hierarchy level %s has ID %d, not greater than its parent's %d", l.Name, int(l.ID), int(levels[i-1].ID))
+		}
+		prefix := strings.ToLower(l.Name) + ":"
+		for _, p := range h.prefixes[:i] {
+			if p == prefix {
+				return nil, invalidArgf("hierarchy level name %q is not unique", l.Name)
+			}
+		}
+		h.prefixes[i] = prefix
+	}
+	return h, nil
+}
+
+func mustHierarchy(levels ...HierarchyLevel) *Hierarchy {
+	h, err := NewHierarchy(levels...)
+	if err != nil {
+		panic(err)
+	}
+	return h
+}
+
+// Levels returns the levels of h, root first.
+func (h *Hierarchy) Levels() []HierarchyLevel {
+	return append([]HierarchyLevel{}, h.levels...)
+}
+
+// Depth returns the number of levels.
+func (h *Hierarchy) Depth() int {
+	return len(h.levels)
+}
+
+// levelName returns the name of the level with ID l, or l's own name for
+// LevelGlobal.
+func (h *Hierarchy) levelName(l Level) string {
+	for _, hl := range h.levels {
+		if hl.ID == l {
+			return hl.Name
+		}
+	}
+	return l.String()
+}
+
+// leaf returns the ID of the deepest level.
+func (h *Hierarchy) leaf() Level {
+	return h.levels[len(h.levels)-1].ID
+}
+
+// validate checks that path addresses a node of h.
+func (h *Hierarchy) validate(path Path) error {
+	if len(path) == 0 {
+		return invalidArgf("path is empty")
+	}
+	if len(path) > len(h.levels) {
+		return invalidArgf("path has %d IDs but the hierarchy has %d levels", len(path), len(h.levels))
+	}
+	for i, id := range path {
+		if id == "" {
+			return invalidArgf("%s ID is required", h.levels[i].Name)
+		}
+	}
+	return nil
+}
+
+// validateParent checks that parent addresses a node of h that has children.
+func (h *Hierarchy) validateParent(parent Path) error {
+	if err := h.validate(parent); err != nil {
+		return err
+	}
+	if len(parent) == len(h.levels) {
+		return invalidArgf("%s has no children", h.name(parent))
+	}
+	return nil
+}
+
+// target returns the bucket row of the node at path. path must be valid.
+func (h *Hierarchy) target(path Path) lockTarget {
+	i := len(path) - 1
+	return lockTarget{level: h.levels[i].ID, bucket: bucket(h.prefixes[i], strings.Join(path, ":"))}
+}
+
+// name formats path such as "Resource(u1/a1/r1)".
+func (h *Hierarchy) name(path Path) string {
+	return h.levels[len(path)-1].Name + "(" + strings.Join(path, "/") + ")"
+}
+
+// step returns the lock statement for the node at path. path must be valid.
+func (h *Hierarchy) step(path Path, mode LockMode, requested bool) lockStep {
+	return lockStep{target: h.target(path), mode: mode, requested: requested, name: h.name(path), path: path}
+}
+
+// pathSteps returns the ancestor->descendant steps for the node at path:
+// ancestors in ancestor, the node itself in mode.
+func (h *Hierarchy) pathSteps(path Path, mode, ancestor LockMode) ([]lockStep, error) {
+	if err := h.validate(path); err != nil {
+		return nil, err
+	}
+	steps := make([]lockStep, 0, len(path))
+	for i := range path {
+		if i == len(path)-1 {
+			steps = append(steps, h.step(path, mode, true))
+		} else {
+			steps = append(steps, h.step(path[:i+1], ancestor, false))
+		}
+	}
+	return steps, nil
+}
+
+// child returns parent extended by id without aliasing parent's array.
+func (p Path) child(id string) Path {
+	return append(append(Path{}, p...), id)
+}
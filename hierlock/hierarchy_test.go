@@ -0,0 +1,151 @@
+package hierlock
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// orgHierarchy is a five-level hierarchy used by the tests below.
+func orgHierarchy(t *testing.T) *Hierarchy {
+	t.Helper()
+	h, err := NewHierarchy(
+		HierarchyLevel{ID: 10, Name: "Org"},
+		HierarchyLevel{ID: 11, Name: "Project"},
+		HierarchyLevel{ID: 12, Name: "Environment"},
+		HierarchyLevel{ID: 13, Name: "Service"},
+		HierarchyLevel{ID: 14, Name: "Instance"},
+	)
+	if err != nil {
+		t.Fatalf("NewHierarchy: %v", err)
+	}
+	return h
+}
+
+// pathTargets returns the rows AcquirePath locks for path, root first.
+func pathTargets(h *Hierarchy, path Path) []lockTarget {
+	tgts := make([]lockTarget, 0, len(path))
+	for i := range path {
+		tgts = append(tgts, h.target(path[:i+1]))
+	}
+	return tgts
+}
+
+func TestNewHierarchy_Validation(t *testing.T) {
+	cases := []struct {
+		name   string
+		levels []HierarchyLevel
+	}{
+		{name: "empty"},
+		{name: "no name", levels: []HierarchyLevel{{ID: 0, Name: ""}}},
+		{name: "ID out of range", levels: []HierarchyLevel{{ID: 128, Name: "Org"}}},
+		{name: "negative ID", levels: []HierarchyLevel{{ID: -1, Name: "Org"}}},
+		{name: "IDs not increasing", levels: []HierarchyLevel{{ID: 2, Name: "Org"}, {ID: 2, Name: "Project"}}},
+		{name: "duplicate name", levels: []HierarchyLevel{{ID: 0, Name: "Org"}, {ID: 1, Name: "org"}}},
+	}
+	for _, tc := range cases {
+		if _, err := NewHierarchy(tc.levels...); !errors.Is(err, ErrInvalidArgument) {
+			t.Fatalf("%s: expected ErrInvalidArgument, got %v", tc.name, err)
+		}
+	}
+}
+
+func TestDefaultHierarchy_KeepsBucketMapping(t *testing.T) {
+	h := DefaultHierarchy()
+	// The historical prefixes, spelled out so the mapping cannot drift.
+	if got, want := h.target(Path{"u1"}), (lockTarget{level: LevelUser, bucket: bucket("user:", "u1")}); got != want {
+		t.Fatalf("User target = %+v, want %+v", got, want)
+	}
+	if got, want := h.target(Path{"u1", "a1"}), (lockTarget{level: LevelAccount, bucket: bucket("account:", "u1:a1")}); got != want {
+		t.Fatalf("Account target = %+v, want %+v", got, want)
+	}
+	if got, want := h.target(Path{"u1", "a1", "r1"}), (lockTarget{level: LevelResource, bucket: bucket("resource:", "u1:a1:r1")}); got != want {
+		t.Fatalf("Resource target = %+v, want %+v", got, want)
+	}
+	if got := h.name(Path{"u1", "a1", "r1"}); got != "Resource(u1/a1/r1)" {
+		t.Fatalf("name = %q", got)
+	}
+}
+
+func TestHierarchy_PathStepsAtAnyDepth(t *testing.T) {
+	h := orgHierarchy(t)
+	path := Path{"o1", "p1", "prod", "api"}
+	steps, err := h.pathSteps(path, ModeExclusive, ModeShared)
+	if err != nil {
+		t.Fatalf("pathSteps: %v", err)
+	}
+	if len(steps) != len(path) {
+		t.Fatalf("got %d steps, want %d", len(steps), len(path))
+	}
+	for i, st := range steps {
+		last := i == len(steps)-1
+		if (st.mode == ModeExclusive) != last || st.requested != last {
+			t.Fatalf("step %d (%s): mode=%v requested=%v", i, st.name, st.mode, st.requested)
+		}
+		if st.target.level != Level(10+i) {
+			t.Fatalf("step %d level = %d, want %d", i, st.target.level, 10+i)
+		}
+	}
+	if got := steps[3].name; got != "Service(o1/p1/prod/api)" {
+		t.Fatalf("target name = %q", got)
+	}
+
+	for _, bad := range []Path{nil, {"o1", ""}, {"a", "b", "c", "d", "e", "f"}} {
+		if _, err := h.pathSteps(bad, ModeExclusive, ModeShared); !errors.Is(err, ErrInvalidArgument) {
+			t.Fatalf("pathSteps(%q): expected ErrInvalidArgument, got %v", bad, err)
+		}
+	}
+}
+
+func TestManager_AcquirePathFiveLevels(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	setupLockTable(ctx, t, db)
+
+	h := orgHierarchy(t)
+	m := NewManager(db, WithHierarchy(h))
+	api := Path{"o1", "p1", "prod", "api"}
+	web := Path{"o1", "p1", "prod", "web"}
+	seedBuckets(ctx, t, db, pathTargets(h, api.child("i1"))...)
+	seedBuckets(ctx, t, db, pathTargets(h, web)...)
+
+	holder, err := m.AcquirePath(ctx, api)
+	if err != nil {
+		t.Fatalf("acquire %v: %v", api, err)
+	}
+	defer holder.Release()
+
+	// Siblings share only ancestors, so they do not block each other.
+	sib, err := m.TryAcquirePath(ctx, web)
+	if err != nil {
+		t.Fatalf("sibling service should not block: %v", err)
+	}
+	_ = sib.Release()
+
+	// A descendant needs the held service shared.
+	if h2, err := m.TryAcquirePath(ctx, api.child("i1")); !errors.Is(err, ErrWouldBlock) {
+		if err == nil {
+			_ = h2.Release()
+		}
+		t.Fatalf("instance under a held service: expected ErrWouldBlock, got %v", err)
+	}
+
+	// So does a shared lock on the service itself.
+	if h2, err := m.TryAcquirePath(ctx, api, WithMode(ModeShared)); !errors.Is(err, ErrWouldBlock) {
+		if err == nil {
+			_ = h2.Release()
+		}
+		t.Fatalf("shared service while held exclusively: expected ErrWouldBlock, got %v", err)
+	}
+
+	// The environment is only held shared, so a shared lock on it coexists.
+	env, err := m.TryAcquirePath(ctx, api[:3], WithMode(ModeShared))
+	if err != nil {
+		t.Fatalf("shared environment should not block: %v", err)
+	}
+	_ = env.Release()
+}
@@ -0,0 +1,177 @@
+package hierlock
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Intention locks (WithIntentionLocks).
+//
+// InnoDB only has S and X row locks, so each node is represented by its
+// bucket row D in hier_lock_buckets plus K intent rows (slots) in
+// hier_lock_intents. The five modes map to:
+//
+//	IS:  D FOR SHARE
+//	IX:  D FOR SHARE, slot s FOR UPDATE
+//	S:   D FOR SHARE, every slot FOR SHARE
+//	SIX: D FOR SHARE, slots in order: s FOR UPDATE, the others FOR SHARE
+//	X:   D FOR UPDATE
+//
+// which reproduces Compatible exactly, except that two IX holders that pick
+// the same slot block each other (a false conflict, like a bucket
+// collision). Each acquisition picks s round-robin per Manager, so up to K
+// concurrent IX holders of a node in one process never collide; across
+// processes the choice is uncorrelated. Rows are always locked D first and
+// then in slot order, so the mapping adds no deadlock of its own.
+//
+// Without intention locks, IS, IX and S take D FOR SHARE and SIX and X take
+// D FOR UPDATE, which is never weaker than the mode asked for.
+
+// maxIntentSlots bounds WithIntentionLocks.
+const maxIntentSlots = 64
+
+// compatibility[held][requested] is the multiple-granularity matrix.
+var compatibility = map[LockMode]map[LockMode]bool{
+	ModeIntentShared:          {ModeIntentShared: true, ModeIntentExclusive: true, ModeShared: true, ModeSharedIntentExclusive: true},
+	ModeIntentExclusive:       {ModeIntentShared: true, ModeIntentExclusive: true},
+	ModeShared:                {ModeIntentShared: true, ModeShared: true},
+	ModeSharedIntentExclusive: {ModeIntentShared: true},
+	ModeExclusive:             {},
+}
+
+// Compatible reports whether a lock in mode requested can be granted on a
+// node while another transaction holds it in mode held. The relation is
+// symmetric.
+func Compatible(held, requested LockMode) bool {
+	return compatibility[held][requested]
+}
+
+func (m LockMode) valid() bool {
+	_, ok := compatibility[m]
+	return ok
+}
+
+// supremum returns the weakest mode at least as strong as both a and b,
+// e.g. SIX for IX and S.
+func supremum(a, b LockMode) LockMode {
+	switch {
+	case a == b:
+		return a
+	case a == ModeExclusive || b == ModeExclusive:
+		return ModeExclusive
+	case a == ModeIntentShared:
+		return b
+	case b == ModeIntentShared:
+		return a
+	default: // two of IX, S and SIX
+		return ModeSharedIntentExclusive
+	}
+}
+
+// intentionMode returns the mode ancestors take for a target locked in mode.
+func intentionMode(mode LockMode) LockMode {
+	switch mode {
+	case ModeShared, ModeIntentShared:
+		return ModeIntentShared
+	default:
+		return ModeIntentExclusive
+	}
+}
+
+// bucketExclusive reports whether st locks its bucket row FOR UPDATE.
+func (st lockStep) bucketExclusive() bool {
+	switch st.mode {
+	case ModeExclusive:
+		return true
+	case ModeSharedIntentExclusive:
+		return st.slots == 0
+	default:
+		return false
+	}
+}
+
+// stepRow is a row locked for a step: the bucket row (slot < 0) or one of
+// its intent rows.
+type stepRow struct {
+	slot      int
+	exclusive bool
+}
+
+// rows returns the rows st locks, in locking order, for backends that lock
+// them one by one. It follows the same mapping as lockIntentRows.
+func (st lockStep) rows() []stepRow {
+	rows := []stepRow{{slot: -1, exclusive: st.bucketExclusive()}}
+	if st.slots == 0 {
+		return rows
+	}
+	switch st.mode {
+	case ModeIntentExclusive:
+		rows = append(rows, stepRow{slot: st.slot, exclusive: true})
+	case ModeShared, ModeSharedIntentExclusive:
+		for i := range st.slots {
+			rows = append(rows, stepRow{slot: i, exclusive: st.mode == ModeSharedIntentExclusive && i == st.slot})
+		}
+	}
+	return rows
+}
+
+// lockIntentRows locks the intent rows st's mode needs, in slot order.
+func lockIntentRows(ctx context.Context, tx *sql.Tx, st lockStep, wait waitPolicy) error {
+	if st.slots == 0 {
+		return nil
+	}
+	last := st.slots - 1
+	switch st.mode {
+	case ModeIntentExclusive:
+		return lockSlots(ctx, tx, st, st.slot, st.slot, true, wait)
+	case ModeShared:
+		return lockSlots(ctx, tx, st, 0, last, false, wait)
+	case ModeSharedIntentExclusive:
+		if st.slot > 0 {
+			if err := lockSlots(ctx, tx, st, 0, st.slot-1, false, wait); err != nil {
+				return err
+			}
+		}
+		if err := lockSlots(ctx, tx, st, st.slot, st.slot, true, wait); err != nil {
+			return err
+		}
+		if st.slot < last {
+			return lockSlots(ctx, tx, st, st.slot+1, last, false, wait)
+		}
+	}
+	return nil
+}
+
+// lockSlots locks the intent rows from..to of st's bucket. Every row must
+// exist; a missing one fails like an unprovisioned bucket.
+func lockSlots(ctx context.Context, tx *sql.Tx, st lockStep, from, to int, exclusive bool, wait waitPolicy) error {
+	query := "SELECT slot FROM hier_lock_intents WHERE level = ? AND bucket = ? AND slot BETWEEN ? AND ?"
+	if exclusive {
+		query += " FOR UPDATE"
+	} else {
+		query += " FOR SHARE"
+	}
+	if wait == waitNoWait {
+		query += " NOWAIT"
+	}
+
+	fail := func(err error) error {
+		return &LockError{Target: st.name, Level: st.target.level, Bucket: st.target.bucket, Exclusive: exclusive, Cause: err}
+	}
+	rows, err := tx.QueryContext(ctx, query, int(st.target.level), st.target.bucket, from, to)
+	if err != nil {
+		return fail(err)
+	}
+	defer rows.Close()
+	n := 0
+	for rows.Next() {
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		return fail(err)
+	}
+	if n != to-from+1 {
+		return fail(sql.ErrNoRows)
+	}
+	return nil
+}
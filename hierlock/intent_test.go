@@ -0,0 +1,143 @@
+package hierlock
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+var allModes = []LockMode{ModeIntentShared, ModeIntentExclusive, ModeShared, ModeSharedIntentExclusive, ModeExclusive}
+
+func TestCompatible_Matrix(t *testing.T) {
+	// Rows are held, columns requested: IS, IX, S, SIX, X.
+	want := [][]bool{
+		{true, true, true, true, false},
+		{true, true, false, false, false},
+		{true, false, true, false, false},
+		{true, false, false, false, false},
+		{false, false, false, false, false},
+	}
+	for i, held := range allModes {
+		for j, req := range allModes {
+			if got := Compatible(held, req); got != want[i][j] {
+				t.Fatalf("Compatible(%v, %v) = %v, want %v", held, req, got, want[i][j])
+			}
+			if Compatible(held, req) != Compatible(req, held) {
+				t.Fatalf("Compatible is not symmetric for %v, %v", held, req)
+			}
+		}
+	}
+	if Compatible(LockMode(42), ModeIntentShared) {
+		t.Fatalf("unknown modes must not be compatible")
+	}
+}
+
+func TestIntentionLocks_EnforceMatrix(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	setupLockTable(ctx, t, db)
+	setupIntentTable(ctx, t, db)
+	tgts := mustTargets(LevelAccount, "u1", "a1", "")
+	seedBuckets(ctx, t, db, tgts...)
+	seedIntents(ctx, t, db, 4, tgts...)
+
+	m := NewManager(db, WithIntentionLocks(4))
+	for _, held := range allModes {
+		for _, req := range allModes {
+			holder, err := m.Acquire(ctx, LevelAccount, "u1", "a1", "", WithMode(held))
+			if err != nil {
+				t.Fatalf("acquire %v: %v", held, err)
+			}
+			h, err := m.TryAcquire(ctx, LevelAccount, "u1", "a1", "", WithMode(req))
+			blocked := errors.Is(err, ErrWouldBlock)
+			if err != nil && !blocked {
+				t.Fatalf("held %v, request %v: %v", held, req, err)
+			}
+			if err == nil {
+				_ = h.Release()
+			}
+			_ = holder.Release()
+			if blocked == Compatible(held, req) {
+				t.Fatalf("held %v, request %v: blocked=%v, want %v", held, req, blocked, !Compatible(held, req))
+			}
+		}
+	}
+}
+
+func TestIntentionLocks_AccountReaderExcludesResourceWriters(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	setupLockTable(ctx, t, db)
+	setupIntentTable(ctx, t, db)
+	a2 := pickDifferentAccountIDNonCollidingResource("u1", "a1", "r1")
+	for _, tgts := range [][]lockTarget{mustTargets(LevelResource, "u1", "a1", "r1"), mustTargets(LevelResource, "u1", a2, "r1")} {
+		seedBuckets(ctx, t, db, tgts...)
+		seedIntents(ctx, t, db, 4, tgts...)
+	}
+
+	m := NewManager(db, WithIntentionLocks(4))
+	reader, err := m.Acquire(ctx, LevelAccount, "u1", "a1", "", WithMode(ModeShared))
+	if err != nil {
+		t.Fatalf("acquire account S: %v", err)
+	}
+	defer reader.Release()
+	if got := targetMode(t, reader, "User(u1)"); got != ModeIntentShared {
+		t.Fatalf("User mode = %v, want IS", got)
+	}
+
+	// The writer's IX on Account(u1/a1) conflicts with the reader's S.
+	if h, err := m.TryAcquire(ctx, LevelResource, "u1", "a1", "r1"); !errors.Is(err, ErrWouldBlock) {
+		if err == nil {
+			_ = h.Release()
+		}
+		t.Fatalf("resource writer under a read Account: expected ErrWouldBlock, got %v", err)
+	}
+
+	// A writer under another account only meets IS on User(u1).
+	h, err := m.TryAcquire(ctx, LevelResource, "u1", a2, "r1")
+	if err != nil {
+		t.Fatalf("resource writer under another account should not block: %v", err)
+	}
+	if got := targetMode(t, h, "Account(u1/"+a2+")"); got != ModeIntentExclusive {
+		t.Fatalf("Account mode = %v, want IX", got)
+	}
+	_ = h.Release()
+
+	// Without intention locks the same pair does not conflict.
+	plain := NewManager(db)
+	h, err = plain.TryAcquire(ctx, LevelResource, "u1", "a1", "r1")
+	if err != nil {
+		t.Fatalf("without intention locks: %v", err)
+	}
+	_ = h.Release()
+}
+
+func TestIntentionLocks_MissingSlotsNotProvisioned(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	setupLockTable(ctx, t, db)
+	setupIntentTable(ctx, t, db)
+	tgts := mustTargets(LevelAccount, "u1", "a1", "")
+	seedBuckets(ctx, t, db, tgts...)
+	seedIntents(ctx, t, db, 2, tgts...)
+
+	m := NewManager(db, WithIntentionLocks(4))
+	h, err := m.Acquire(ctx, LevelAccount, "u1", "a1", "", WithMode(ModeShared))
+	if err == nil {
+		_ = h.Release()
+		t.Fatalf("expected ErrBucketNotProvisioned")
+	}
+	if !errors.Is(err, ErrBucketNotProvisioned) {
+		t.Fatalf("expected ErrBucketNotProvisioned, got %v", err)
+	}
+}
@@ -0,0 +1,238 @@
+package hierlock
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Lock order validation (WithLockOrderValidator).
+//
+// Each acquisition is ordered on its own, but nothing orders separate
+// handles: a goroutine that holds a Resource and then takes its User on
+// another handle can deadlock with one that does the opposite, and review
+// rarely spots it. Like the kernel's lockdep, the validator learns the order
+// in which lock classes are taken and reports an inversion the first time
+// it is observed, whether or not a deadlock actually happens.
+//
+// A class groups nodes, by default by level name ("Resource", or the name
+// given to NewHierarchy); WithLockClass can refine it, e.g. by ID pattern.
+// Whenever rows are about to be locked, an edge A -> B is learned for every
+// class A held by the same scope and every class B about to be locked. The
+// scope is the goroutine, or the context returned by OrderScope when the
+// work of one logical task spans goroutines. Within one acquisition only
+// edges between levels are learned, since rows of a level are already
+// ordered by bucket. If B already reaches A through learned edges, A -> B is
+// an inversion: it is reported with the stack of the current observation and
+// those of the earlier ones, and is not learned.
+//
+// Upgrade, AcquireInTx (including AddResources on its handles) and the
+// TryAcquire family are not validated: the first re-locks rows it holds, the
+// caller's transaction outlives Release, and the others never wait. Handles
+// from the TryAcquire family and ClaimResources still count as held. Like
+// lockdep, the validator is conservative: it ignores modes, so an inversion
+// between two classes only ever locked shared is reported too.
+//
+// Taking a second handle under the same User while holding a Resource is
+// reported as well (Account -> User, Resource -> User). That order is
+// unsafe even though the ancestors are shared: InnoDB queues the new shared
+// request behind a waiting exclusive one, which in turn waits for the
+// rows held by the first handle. Acquire both in one call (AcquireSet)
+// instead.
+
+// LockOrderEdge is an observed order between two lock classes: To was
+// about to be locked while From was held.
+type LockOrderEdge struct {
+	From, To             string // classes
+	FromTarget, ToTarget string // the nodes of the observation, e.g. "User(u1)"
+	Stack                []byte // the goroutine's stack at the observation
+}
+
+// LockOrderInversion reports an order that contradicts earlier ones.
+type LockOrderInversion struct {
+	// New is the order just observed.
+	New LockOrderEdge
+	// Prior is the chain of earlier orders from New.To back to New.From.
+	Prior []LockOrderEdge
+}
+
+func (i LockOrderInversion) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "hierlock: lock order inversion: %s (%s) locked while holding %s (%s)\n%s",
+		i.New.To, i.New.ToTarget, i.New.From, i.New.FromTarget, i.New.Stack)
+	for _, e := range i.Prior {
+		fmt.Fprintf(&b, "\nearlier, %s (%s) was locked while holding %s (%s)\n%s",
+			e.To, e.ToTarget, e.From, e.FromTarget, e.Stack)
+	}
+	return b.String()
+}
+
+// WithLockOrderValidator makes the manager learn the order of lock classes
+// across all handles of a goroutine (or OrderScope) and call report once
+// per inverted pair of classes. report is called synchronously before the
+// offending lock statement, so it may panic to fail a test. A nil report
+// disables the validator.
+func WithLockOrderValidator(report func(LockOrderInversion)) ManagerOption {
+	return func(m *Manager) {
+		m.order = nil
+		if report != nil {
+			m.order = &orderValidator{
+				report:   report,
+				edges:    map[[2]string]LockOrderEdge{},
+				reported: map[[2]string]bool{},
+				held:     map[any]map[*LockHandle][]lockStep{},
+			}
+		}
+	}
+}
+
+// WithLockClass sets the lock class of the node with the given level and
+// ID for WithLockOrderValidator. The default is the level name.
+func WithLockClass(class func(level Level, id string) string) ManagerOption {
+	return func(m *Manager) {
+		m.lockClass = class
+	}
+}
+
+type orderScopeKey struct{}
+
+type orderScope struct{}
+
+// OrderScope returns a context whose acquisitions form one scope for
+// WithLockOrderValidator, whatever goroutine they run on.
+func OrderScope(ctx context.Context) context.Context {
+	return context.WithValue(ctx, orderScopeKey{}, &orderScope{})
+}
+
+type orderValidator struct {
+	report func(LockOrderInversion)
+
+	mu       sync.Mutex
+	edges    map[[2]string]LockOrderEdge
+	reported map[[2]string]bool
+	held     map[any]map[*LockHandle][]lockStep // rows of each handle, by scope
+}
+
+func scopeOf(ctx context.Context) any {
+	if s, ok := ctx.Value(orderScopeKey{}).(*orderScope); ok {
+		return s
+	}
+	return goroutineID()
+}
+
+// classOf returns the lock class of st's node.
+func (m *Manager) classOf(st lockStep) string {
+	if m.lockClass == nil {
+		return m.h.levelName(st.target.level)
+	}
+	return m.lockClass(st.target.level, st.id())
+}
+
+// checkOrder learns the edges from the rows held by ctx's scope, and from
+// earlier levels of steps, to steps, reporting inversions.
+func (m *Manager) checkOrder(ctx context.Context, steps []lockStep) {
+	v := m.order
+	if v == nil {
+		return
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	var held []lockStep
+	for _, steps := range v.held[scopeOf(ctx)] {
+		held = append(held, steps...)
+	}
+	var stack []byte
+	for i, st := range steps {
+		from := slices.Clone(held)
+		for _, prev := range steps[:i] {
+			if prev.target.level != st.target.level {
+				from = append(from, prev)
+			}
+		}
+		for _, f := range from {
+			a, b := m.classOf(f), m.classOf(st)
+			if a == b || v.reported[[2]string{a, b}] {
+				continue
+			}
+			if _, ok := v.edges[[2]string{a, b}]; ok {
+				continue
+			}
+			if stack == nil {
+				stack = debug.Stack()
+			}
+			e := LockOrderEdge{From: a, To: b, FromTarget: f.name, ToTarget: st.name, Stack: stack}
+			if chain := v.chain(b, a); chain != nil {
+				v.reported[[2]string{a, b}] = true
+				v.report(LockOrderInversion{New: e, Prior: chain})
+				continue
+			}
+			v.edges[[2]string{a, b}] = e
+		}
+	}
+}
+
+// chain returns learned edges leading from class a to class b, or nil.
+// v.mu must be held.
+func (v *orderValidator) chain(a, b string) []LockOrderEdge {
+	visited := map[string]bool{a: true}
+	var path []LockOrderEdge
+	var visit func(c string) bool
+	visit = func(c string) bool {
+		for _, e := range v.edges {
+			if e.From != c || visited[e.To] {
+				continue
+			}
+			path = append(path, e)
+			if e.To == b {
+				return true
+			}
+			visited[e.To] = true
+			if visit(e.To) {
+				return true
+			}
+			path = path[:len(path)-1]
+		}
+		return false
+	}
+	if visit(a) {
+		return path
+	}
+	return nil
+}
+
+// holdOrder adds h, or its current rows, to its scope: ctx's scope for a
+// new handle.
+func (m *Manager) holdOrder(ctx context.Context, h *LockHandle) {
+	v := m.order
+	if v == nil || h == nil {
+		return
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if h.orderScope == nil {
+		h.orderScope = scopeOf(ctx)
+	}
+	if v.held[h.orderScope] == nil {
+		v.held[h.orderScope] = map[*LockHandle][]lockStep{}
+	}
+	v.held[h.orderScope][h] = slices.Clone(h.steps)
+}
+
+// releaseOrder removes h from its scope.
+func (m *Manager) releaseOrder(h *LockHandle) {
+	v := m.order
+	if v == nil || h.orderScope == nil {
+		return
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	delete(v.held[h.orderScope], h)
+	if len(v.held[h.orderScope]) == 0 {
+		delete(v.held, h.orderScope)
+	}
+	h.orderScope = nil
+}
@@ -0,0 +1,248 @@
+package hierlock
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type inversionLog struct {
+	mu   sync.Mutex
+	list []LockOrderInversion
+}
+
+func (l *inversionLog) report(i LockOrderInversion) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.list = append(l.list, i)
+}
+
+func (l *inversionLog) len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.list)
+}
+
+func mustPathSteps(t *testing.T, m *Manager, path Path, mode LockMode) []lockStep {
+	t.Helper()
+	steps, err := m.pathSteps(path, mode)
+	if err != nil {
+		t.Fatalf("pathSteps(%v): %v", path, err)
+	}
+	return steps
+}
+
+func TestLockOrderValidator_ReportsInversionOnce(t *testing.T) {
+	var log inversionLog
+	m := NewManager(nil, WithLockOrderValidator(log.report))
+	ctx := context.Background()
+
+	// An ordinary Resource acquisition teaches User -> Account -> Resource.
+	m.checkOrder(ctx, mustPathSteps(t, m, Path{"u1", "a1", "r1"}, ModeExclusive))
+	if log.len() != 0 {
+		t.Fatalf("ordered acquisition reported: %+v", log.list)
+	}
+
+	// Holding the Resource, this goroutine now takes another User.
+	h := &LockHandle{m: m, steps: mustPathSteps(t, m, Path{"u1", "a1", "r1"}, ModeExclusive)}
+	m.holdOrder(ctx, h)
+	m.checkOrder(ctx, mustPathSteps(t, m, Path{"u2"}, ModeExclusive))
+	if log.len() != 2 {
+		t.Fatalf("got %d inversions, want Account -> User and Resource -> User: %+v", log.len(), log.list)
+	}
+	var inv *LockOrderInversion
+	for i := range log.list {
+		if log.list[i].New.From == "Resource" {
+			inv = &log.list[i]
+		}
+	}
+	if inv == nil || inv.New.To != "User" || inv.New.ToTarget != "User(u2)" || inv.New.FromTarget != "Resource(u1/a1/r1)" {
+		t.Fatalf("inversions = %+v", log.list)
+	}
+	if len(inv.Prior) == 0 || inv.Prior[0].From != "User" || inv.Prior[len(inv.Prior)-1].To != "Resource" {
+		t.Fatalf("prior chain = %+v, want User ... -> Resource", inv.Prior)
+	}
+	if len(inv.New.Stack) == 0 || len(inv.Prior[0].Stack) == 0 {
+		t.Fatalf("both stacks must be recorded")
+	}
+	if !strings.Contains(inv.String(), "TestLockOrderValidator_ReportsInversionOnce") {
+		t.Fatalf("report does not include the stacks:\n%s", inv)
+	}
+
+	// Only the first occurrence is reported.
+	m.checkOrder(ctx, mustPathSteps(t, m, Path{"u3"}, ModeShared))
+	if log.len() != 2 {
+		t.Fatalf("inversion reported again: %d", log.len())
+	}
+
+	// Once released, the handle no longer counts; another goroutine never did.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.checkOrder(ctx, mustPathSteps(t, m, Path{"u4"}, ModeShared))
+	}()
+	<-done
+	m.releaseOrder(h)
+	m.checkOrder(ctx, mustPathSteps(t, m, Path{"u5"}, ModeShared))
+	if log.len() != 2 {
+		t.Fatalf("unexpected report: %+v", log.list[2:])
+	}
+}
+
+func TestLockOrderValidator_OrderScopeSpansGoroutines(t *testing.T) {
+	var log inversionLog
+	m := NewManager(nil, WithLockOrderValidator(log.report))
+	m.checkOrder(context.Background(), mustPathSteps(t, m, Path{"u1", "a1"}, ModeExclusive))
+
+	ctx := OrderScope(context.Background())
+	h := &LockHandle{m: m, steps: mustPathSteps(t, m, Path{"u1", "a1"}, ModeExclusive)}
+	m.holdOrder(ctx, h)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.checkOrder(ctx, mustPathSteps(t, m, Path{"u2"}, ModeExclusive))
+	}()
+	<-done
+	if log.len() != 1 || log.list[0].New.From != "Account" {
+		t.Fatalf("inversions = %+v, want Account -> User", log.list)
+	}
+}
+
+func TestLockOrderValidator_LockClass(t *testing.T) {
+	var log inversionLog
+	class := func(level Level, id string) string {
+		if level == LevelResource {
+			kind, _, _ := strings.Cut(id, "-")
+			return "Resource:" + kind
+		}
+		return level.String()
+	}
+	m := NewManager(nil, WithLockOrderValidator(log.report), WithLockClass(class))
+	ctx := context.Background()
+
+	// Only the Resource rows: a second handle re-locking the shared ancestors
+	// would itself be reported (Account -> User).
+	hold := func(path Path) *LockHandle {
+		h := &LockHandle{m: m, steps: mustPathSteps(t, m, path, ModeExclusive)[2:]}
+		m.checkOrder(ctx, h.steps)
+		m.holdOrder(ctx, h)
+		return h
+	}
+	invoice := hold(Path{"u1", "a1", "invoice-1"})
+	payment := hold(Path{"u1", "a1", "payment-1"}) // teaches invoice -> payment
+	m.releaseOrder(invoice)
+	m.releaseOrder(payment)
+	if log.len() != 0 {
+		t.Fatalf("unexpected report: %+v", log.list)
+	}
+
+	payment = hold(Path{"u1", "a1", "payment-2"})
+	defer m.releaseOrder(payment)
+	m.checkOrder(ctx, mustPathSteps(t, m, Path{"u1", "a1", "invoice-2"}, ModeExclusive)[2:])
+	if log.len() != 1 || log.list[0].New.From != "Resource:payment" || log.list[0].New.To != "Resource:invoice" {
+		t.Fatalf("inversions = %+v, want payment -> invoice", log.list)
+	}
+}
+
+func TestLockOrderValidator_CustomHierarchyClasses(t *testing.T) {
+	var log inversionLog
+	m := NewManager(nil, WithHierarchy(orgHierarchy(t)), WithLockOrderValidator(log.report))
+	ctx := context.Background()
+
+	m.checkOrder(ctx, mustPathSteps(t, m, Path{"o1", "p1", "e1"}, ModeExclusive))
+	h := &LockHandle{m: m, steps: mustPathSteps(t, m, Path{"o1", "p1", "e1"}, ModeExclusive)}
+	m.holdOrder(ctx, h)
+	defer m.releaseOrder(h)
+	m.checkOrder(ctx, mustPathSteps(t, m, Path{"o2"}, ModeExclusive))
+
+	got := map[string]bool{}
+	for _, inv := range log.list {
+		if inv.New.To != "Org" {
+			t.Fatalf("inversion = %+v, want one to Org", inv.New)
+		}
+		got[inv.New.From] = true
+	}
+	if len(got) != 2 || !got["Project"] || !got["Environment"] {
+		t.Fatalf("inversions = %+v, want Project -> Org and Environment -> Org", log.list)
+	}
+}
+
+func TestLockOrderValidator_RepositoryResourceThenUser(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	setupLockTable(ctx, t, db)
+	u2 := pickDifferentUserIDNonColliding("u1", "a1", "r1")
+	seedBuckets(ctx, t, db, mustTargets(LevelResource, "u1", "a1", "r1")...)
+	seedBuckets(ctx, t, db, userTarget(u2))
+
+	var log inversionLog
+	repo := NewRepository(db, WithLockOrderValidator(log.report))
+	res, err := repo.GetResourceLock(ctx, "u1", "a1", "r1")
+	if err != nil {
+		t.Fatalf("GetResourceLock: %v", err)
+	}
+	user, err := repo.GetUserLock(ctx, u2)
+	if err != nil {
+		t.Fatalf("GetUserLock: %v", err)
+	}
+	_ = user.Release()
+	_ = res.Release()
+
+	if log.len() == 0 {
+		t.Fatalf("expected Resource -> User to be reported")
+	}
+}
+
+func TestLockOrderValidator_AddResourcesInTxIsNotHeld(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	setupLockTable(ctx, t, db)
+	u2 := pickDifferentUserIDNonColliding("u1", "a1", "r1")
+	seedBuckets(ctx, t, db, mustTargets(LevelResource, "u1", "a1", "r1")...)
+	seedBuckets(ctx, t, db, userTarget(u2))
+
+	var log inversionLog
+	m := NewManager(db, WithLockOrderValidator(log.report))
+
+	// Teach User -> Account -> Resource.
+	h, err := m.Acquire(ctx, LevelResource, "u1", "a1", "r1")
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	_ = h.Release()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("BeginTx: %v", err)
+	}
+	defer tx.Rollback()
+	h, err = m.AcquireInTx(ctx, tx, LevelAccount, "u1", "a1", "")
+	if err != nil {
+		t.Fatalf("AcquireInTx: %v", err)
+	}
+	if err := h.AddResources(ctx, "r1"); err != nil {
+		t.Fatalf("AddResources: %v", err)
+	}
+	_ = h.Release()
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+
+	// The committed rows are gone, so taking another User is not an inversion.
+	user, err := m.Acquire(ctx, LevelUser, u2, "", "")
+	if err != nil {
+		t.Fatalf("Acquire(%s): %v", u2, err)
+	}
+	_ = user.Release()
+	if log.len() != 0 {
+		t.Fatalf("unexpected report: %+v", log.list)
+	}
+}
@@ -0,0 +1,149 @@
+package hierlock
+
+import (
+	"context"
+)
+
+// Handle is a set of locks held by a Locker until Release.
+type Handle interface {
+	Release() error
+}
+
+// Locker acquires hierarchy locks. It is the part of Manager that
+// LockerRepository and application code need, so that the MySQL bucket backend
+// (Manager.Locker) can be swapped for another one per environment, or
+// faked in tests.
+//
+// Implementations follow the Manager's rules: ancestors are locked shared
+// and targets in their mode, multi-target acquisitions lock in one global
+// order, and the Try methods fail with ErrWouldBlock instead of waiting.
+type Locker interface {
+	Acquire(ctx context.Context, level Level, userID, accountID, resourceID string, opts ...AcquireOption) (Handle, error)
+	TryAcquire(ctx context.Context, level Level, userID, accountID, resourceID string, opts ...AcquireOption) (Handle, error)
+	AcquireResources(ctx context.Context, userID, accountID string, resourceIDs []string, opts ...AcquireOption) (Handle, error)
+	TryAcquireResources(ctx context.Context, userID, accountID string, resourceIDs []string, opts ...AcquireOption) (Handle, error)
+	AcquireSet(ctx context.Context, reqs []LockRequest, opts ...AcquireOption) (Handle, error)
+	TryAcquireSet(ctx context.Context, reqs []LockRequest, opts ...AcquireOption) (Handle, error)
+}
+
+// Locker returns m as a Locker. Its handles are *LockHandle.
+func (m *Manager) Locker() Locker {
+	return managerLocker{m}
+}
+
+type managerLocker struct {
+	m *Manager
+}
+
+// handle converts the result of a Manager method, keeping a nil Handle on
+// error rather than a typed nil.
+func handle(h *LockHandle, err error) (Handle, error) {
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (l managerLocker) Acquire(ctx context.Context, level Level, userID, accountID, resourceID string, opts ...AcquireOption) (Handle, error) {
+	return handle(l.m.Acquire(ctx, level, userID, accountID, resourceID, opts...))
+}
+
+func (l managerLocker) TryAcquire(ctx context.Context, level Level, userID, accountID, resourceID string, opts ...AcquireOption) (Handle, error) {
+	return handle(l.m.TryAcquire(ctx, level, userID, accountID, resourceID, opts...))
+}
+
+func (l managerLocker) AcquireResources(ctx context.Context, userID, accountID string, resourceIDs []string, opts ...AcquireOption) (Handle, error) {
+	return handle(l.m.AcquireResources(ctx, userID, accountID, resourceIDs, opts...))
+}
+
+func (l managerLocker) TryAcquireResources(ctx context.Context, userID, accountID string, resourceIDs []string, opts ...AcquireOption) (Handle, error) {
+	return handle(l.m.TryAcquireResources(ctx, userID, accountID, resourceIDs, opts...))
+}
+
+func (l managerLocker) AcquireSet(ctx context.Context, reqs []LockRequest, opts ...AcquireOption) (Handle, error) {
+	return handle(l.m.AcquireSet(ctx, reqs, opts...))
+}
+
+func (l managerLocker) TryAcquireSet(ctx context.Context, reqs []LockRequest, opts ...AcquireOption) (Handle, error) {
+	return handle(l.m.TryAcquireSet(ctx, reqs, opts...))
+}
+
+// stepLocker implements Locker for backends that plan acquisitions exactly
+// like Manager (hierarchy, striping, order, modes, escalation) and only
+// differ in how they take the planned rows: lock takes steps in order and
+// returns a handle holding all of them, or releases what it took.
+type stepLocker struct {
+	plan *Manager // plans steps; never touches a database
+	lock func(ctx context.Context, steps []lockStep, cfg acquireConfig) (Handle, error)
+}
+
+func (l stepLocker) Acquire(ctx context.Context, level Level, userID, accountID, resourceID string, opts ...AcquireOption) (Handle, error) {
+	return l.acquire(ctx, level, userID, accountID, resourceID, waitBlock, opts)
+}
+
+func (l stepLocker) TryAcquire(ctx context.Context, level Level, userID, accountID, resourceID string, opts ...AcquireOption) (Handle, error) {
+	return l.acquire(ctx, level, userID, accountID, resourceID, waitNoWait, opts)
+}
+
+func (l stepLocker) acquire(ctx context.Context, level Level, userID, accountID, resourceID string, wait waitPolicy, opts []AcquireOption) (Handle, error) {
+	cfg, err := newAcquireConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	cfg.wait = wait
+	path, err := typedPath(level, userID, accountID, resourceID)
+	if err != nil {
+		return nil, err
+	}
+	steps, err := l.plan.pathSteps(path, cfg.mode)
+	if err != nil {
+		return nil, err
+	}
+	return l.lock(ctx, steps, cfg)
+}
+
+func (l stepLocker) AcquireResources(ctx context.Context, userID, accountID string, resourceIDs []string, opts ...AcquireOption) (Handle, error) {
+	return l.acquireResources(ctx, userID, accountID, resourceIDs, waitBlock, opts)
+}
+
+func (l stepLocker) TryAcquireResources(ctx context.Context, userID, accountID string, resourceIDs []string, opts ...AcquireOption) (Handle, error) {
+	return l.acquireResources(ctx, userID, accountID, resourceIDs, waitNoWait, opts)
+}
+
+func (l stepLocker) acquireResources(ctx context.Context, userID, accountID string, resourceIDs []string, wait waitPolicy, opts []AcquireOption) (Handle, error) {
+	cfg, err := newAcquireConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	cfg.wait = wait
+	if err := validateResources(userID, accountID, resourceIDs); err != nil {
+		return nil, err
+	}
+	steps, _, _, err := l.plan.childSteps(Path{userID, accountID}, resourceIDs, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return l.lock(ctx, steps, cfg)
+}
+
+func (l stepLocker) AcquireSet(ctx context.Context, reqs []LockRequest, opts ...AcquireOption) (Handle, error) {
+	return l.acquireSet(ctx, reqs, waitBlock, opts)
+}
+
+func (l stepLocker) TryAcquireSet(ctx context.Context, reqs []LockRequest, opts ...AcquireOption) (Handle, error) {
+	return l.acquireSet(ctx, reqs, waitNoWait, opts)
+}
+
+func (l stepLocker) acquireSet(ctx context.Context, reqs []LockRequest, wait waitPolicy, opts []AcquireOption) (Handle, error) {
+	cfg, err := newAcquireConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	cfg.wait = wait
+	steps, err := l.plan.setSteps(reqs)
+	if err != nil {
+		return nil, err
+	}
+	steps, _ = planSteps(steps)
+	return l.lock(ctx, steps, cfg)
+}
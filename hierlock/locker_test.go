@@ -0,0 +1,111 @@
+package hierlock
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// recordingLocker is a Locker that grants everything and records the calls.
+type recordingLocker struct {
+	calls []string
+	sets  [][]LockRequest
+}
+
+type nopHandle struct{}
+
+func (nopHandle) Release() error { return nil }
+
+func (l *recordingLocker) Acquire(ctx context.Context, level Level, userID, accountID, resourceID string, opts ...AcquireOption) (Handle, error) {
+	l.calls = append(l.calls, "Acquire")
+	return nopHandle{}, nil
+}
+
+func (l *recordingLocker) TryAcquire(ctx context.Context, level Level, userID, accountID, resourceID string, opts ...AcquireOption) (Handle, error) {
+	l.calls = append(l.calls, "TryAcquire")
+	return nopHandle{}, nil
+}
+
+func (l *recordingLocker) AcquireResources(ctx context.Context, userID, accountID string, resourceIDs []string, opts ...AcquireOption) (Handle, error) {
+	l.calls = append(l.calls, "AcquireResources")
+	return nopHandle{}, nil
+}
+
+func (l *recordingLocker) TryAcquireResources(ctx context.Context, userID, accountID string, resourceIDs []string, opts ...AcquireOption) (Handle, error) {
+	l.calls = append(l.calls, "TryAcquireResources")
+	return nopHandle{}, nil
+}
+
+func (l *recordingLocker) AcquireSet(ctx context.Context, reqs []LockRequest, opts ...AcquireOption) (Handle, error) {
+	l.calls = append(l.calls, "AcquireSet")
+	l.sets = append(l.sets, reqs)
+	return nopHandle{}, nil
+}
+
+func (l *recordingLocker) TryAcquireSet(ctx context.Context, reqs []LockRequest, opts ...AcquireOption) (Handle, error) {
+	l.calls = append(l.calls, "TryAcquireSet")
+	l.sets = append(l.sets, reqs)
+	return nopHandle{}, nil
+}
+
+func TestLockerRepository_UsesLocker(t *testing.T) {
+	l := &recordingLocker{}
+	repo := NewLockerRepository(l)
+	ctx := context.Background()
+
+	if _, err := repo.GetResourceLock(ctx, "u1", "a1", "r1"); err != nil {
+		t.Fatalf("GetResourceLock: %v", err)
+	}
+	if _, err := repo.TryGetResourcesLock(ctx, "u1", "a1", []string{"r1", "r2"}); err != nil {
+		t.Fatalf("TryGetResourcesLock: %v", err)
+	}
+	if _, err := repo.GetAccountsLock(ctx, "u1", []string{"a1", "a2"}, WithMode(ModeShared)); err != nil {
+		t.Fatalf("GetAccountsLock: %v", err)
+	}
+	from := LockRequest{Level: LevelAccount, UserID: "u1", AccountID: "a1", Mode: ModeShared}
+	to := LockRequest{Level: LevelAccount, UserID: "u2", AccountID: "a1"}
+	if _, err := repo.TryGetTransferLock(ctx, from, to); err != nil {
+		t.Fatalf("TryGetTransferLock: %v", err)
+	}
+
+	want := []string{"Acquire", "TryAcquireResources", "AcquireSet", "TryAcquireSet"}
+	if len(l.calls) != len(want) {
+		t.Fatalf("calls = %v, want %v", l.calls, want)
+	}
+	for i := range want {
+		if l.calls[i] != want[i] {
+			t.Fatalf("calls = %v, want %v", l.calls, want)
+		}
+	}
+	for _, req := range l.sets[0] {
+		if req.Level != LevelAccount || req.Mode != ModeShared {
+			t.Fatalf("GetAccountsLock request = %+v, want shared Account", req)
+		}
+	}
+	for _, req := range l.sets[1] {
+		if req.Mode != ModeExclusive {
+			t.Fatalf("transfer end = %+v, want exclusive", req)
+		}
+	}
+
+	if _, err := repo.GetAccountsLock(ctx, "u1", nil); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("expected ErrInvalidArgument before reaching the Locker, got %v", err)
+	}
+	if _, err := repo.GetTransferLock(ctx, from, from); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("expected ErrInvalidArgument before reaching the Locker, got %v", err)
+	}
+	if len(l.calls) != len(want) {
+		t.Fatalf("invalid requests reached the Locker: %v", l.calls[len(want):])
+	}
+}
+
+func TestManagerLocker_NilHandleOnError(t *testing.T) {
+	l := NewManager(nil).Locker()
+	h, err := l.Acquire(context.Background(), LevelUser, "u1", "", "")
+	if err == nil {
+		t.Fatalf("expected an error from a manager without db")
+	}
+	if h != nil {
+		t.Fatalf("handle = %#v, want a nil interface", h)
+	}
+}
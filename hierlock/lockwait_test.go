@@ -0,0 +1,137 @@
+package hierlock
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAcquire_LockWaitTimeoutReportsTarget(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	setupLockTable(ctx, t, db)
+	seedBuckets(ctx, t, db, mustTargets(LevelResource, "u1", "a1", "r1")...)
+
+	m := NewManager(db)
+
+	holder, err := m.Acquire(ctx, LevelAccount, "u1", "a1", "")
+	if err != nil {
+		t.Fatalf("acquire account: %v", err)
+	}
+	defer holder.Release()
+
+	start := time.Now()
+	h, err := m.Acquire(ctx, LevelResource, "u1", "a1", "r1",
+		WithLockWaitTimeout(30*time.Second),
+		WithLevelLockWaitTimeout(LevelAccount, time.Second),
+	)
+	if err == nil {
+		_ = h.Release()
+		t.Fatalf("expected ErrLockWaitTimeout, got nil")
+	}
+	if !errors.Is(err, ErrLockWaitTimeout) {
+		t.Fatalf("expected ErrLockWaitTimeout, got: %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("per-level timeout should win over the global one, waited %v", d)
+	}
+	var le *LockError
+	if !errors.As(err, &le) {
+		t.Fatalf("expected *LockError, got %T", err)
+	}
+	if want := accountTarget("u1", "a1"); le.Level != want.level || le.Bucket != want.bucket {
+		t.Fatalf("timed out target = (%d,%d), want (%d,%d)", le.Level, le.Bucket, want.level, want.bucket)
+	}
+}
+
+func TestAcquire_ContextLockWaitTimeoutEndsServerWait(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	setupLockTable(ctx, t, db)
+	seedBuckets(ctx, t, db, mustTargets(LevelUser, "u1", "", "")...)
+
+	m := NewManager(db)
+
+	holder, err := m.Acquire(ctx, LevelUser, "u1", "", "")
+	if err != nil {
+		t.Fatalf("acquire user: %v", err)
+	}
+	defer holder.Release()
+
+	// With a 2.5s deadline the server gives up after 2s, before the client does,
+	// so the caller sees the typed timeout rather than a context error.
+	cctx, ccancel := context.WithTimeout(ctx, 2500*time.Millisecond)
+	defer ccancel()
+	_, err = m.Acquire(cctx, LevelUser, "u1", "", "", WithContextLockWaitTimeout())
+	if !errors.Is(err, ErrLockWaitTimeout) {
+		t.Fatalf("expected ErrLockWaitTimeout, got: %v", err)
+	}
+}
+
+func TestAcquire_LockWaitTimeoutDoesNotLeakIntoSession(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	setupLockTable(ctx, t, db)
+	seedBuckets(ctx, t, db, mustTargets(LevelAccount, "u1", "a1", "")...)
+
+	m := NewManager(db)
+
+	h, err := m.Acquire(ctx, LevelAccount, "u1", "a1", "", WithLockWaitTimeout(time.Second))
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	defer h.Release()
+
+	var session, global int
+	if err := h.tx.QueryRowContext(ctx, "SELECT @@SESSION.innodb_lock_wait_timeout, @@GLOBAL.innodb_lock_wait_timeout").Scan(&session, &global); err != nil {
+		t.Fatalf("read innodb_lock_wait_timeout: %v", err)
+	}
+	if session != global {
+		t.Fatalf("session innodb_lock_wait_timeout = %d after acquire, want server default %d", session, global)
+	}
+}
+
+func TestLockWaitSeconds(t *testing.T) {
+	noDeadline := context.Background()
+	withDeadline, cancel := context.WithTimeout(context.Background(), 3500*time.Millisecond)
+	defer cancel()
+
+	cases := []struct {
+		name string
+		ctx  context.Context
+		opts []AcquireOption
+		want int
+	}{
+		{name: "server default", ctx: noDeadline, want: 0},
+		{name: "explicit rounds up", ctx: noDeadline, opts: []AcquireOption{WithLockWaitTimeout(1500 * time.Millisecond)}, want: 2},
+		{name: "explicit minimum one second", ctx: noDeadline, opts: []AcquireOption{WithLockWaitTimeout(time.Millisecond)}, want: 1},
+		{name: "level overrides explicit", ctx: noDeadline, opts: []AcquireOption{WithLockWaitTimeout(10 * time.Second), WithLevelLockWaitTimeout(LevelAccount, 2*time.Second)}, want: 2},
+		{name: "level zero keeps server default", ctx: withDeadline, opts: []AcquireOption{WithContextLockWaitTimeout(), WithLockWaitTimeout(10 * time.Second), WithLevelLockWaitTimeout(LevelAccount, 0)}, want: 0},
+		{name: "other level falls back to explicit", ctx: noDeadline, opts: []AcquireOption{WithLockWaitTimeout(10 * time.Second), WithLevelLockWaitTimeout(LevelUser, 2*time.Second)}, want: 10},
+		{name: "context deadline rounds down", ctx: withDeadline, opts: []AcquireOption{WithContextLockWaitTimeout()}, want: 3},
+		{name: "context without deadline", ctx: noDeadline, opts: []AcquireOption{WithContextLockWaitTimeout()}, want: 0},
+		{name: "explicit overrides context", ctx: withDeadline, opts: []AcquireOption{WithContextLockWaitTimeout(), WithLockWaitTimeout(7 * time.Second)}, want: 7},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, err := newAcquireConfig(tc.opts)
+			if err != nil {
+				t.Fatalf("newAcquireConfig: %v", err)
+			}
+			if got := cfg.lockWaitSeconds(tc.ctx, LevelAccount); got != tc.want {
+				t.Fatalf("lockWaitSeconds = %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
@@ -3,9 +3,14 @@ package hierlock
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
 	"hash/fnv"
+	"slices"
 	"sort"
+	"sync/atomic"
+	"time"
 )
 
 const lockBucketSpace = 10_000_000
@@ -18,117 +23,583 @@ const (
 	LevelResource
 )
 
-type LockHandle struct {
-	tx *sql.Tx
+// LevelGlobal is the optional root above every hierarchy; see WithGlobalLock.
+const LevelGlobal Level = -1
+
+func (l Level) String() string {
+	switch l {
+	case LevelGlobal:
+		return "Global"
+	case LevelUser:
+		return "User"
+	case LevelAccount:
+		return "Account"
+	case LevelResource:
+		return "Resource"
+	default:
+		return fmt.Sprintf("Level(%d)", int(l))
+	}
 }
 
-// Release releases all row locks by rolling back the underlying transaction.
-// (We intentionally rollback because this is a pure lock acquisition transaction.)
-func (h *LockHandle) Release() error {
-	if h == nil || h.tx == nil {
-		return nil
+// LockMode selects how the target of an acquisition is locked. Which
+// modes coexist is given by Compatible.
+//
+// Ancestors are locked in shared mode, or in the intention mode of the
+// target's mode when the manager uses WithIntentionLocks.
+type LockMode int
+
+const (
+	// ModeExclusive locks the target FOR UPDATE. It is the default.
+	ModeExclusive LockMode = iota
+	// ModeShared locks the target FOR SHARE, so shared holders of the same
+	// target coexist while exclusive holders are blocked.
+	ModeShared
+	// ModeIntentShared (IS) announces shared locks below the node.
+	ModeIntentShared
+	// ModeIntentExclusive (IX) announces exclusive locks below the node.
+	ModeIntentExclusive
+	// ModeSharedIntentExclusive (SIX) reads the whole node while announcing
+	// exclusive locks below it.
+	ModeSharedIntentExclusive
+)
+
+func (m LockMode) String() string {
+	switch m {
+	case ModeExclusive:
+		return "X"
+	case ModeShared:
+		return "S"
+	case ModeIntentShared:
+		return "IS"
+	case ModeIntentExclusive:
+		return "IX"
+	case ModeSharedIntentExclusive:
+		return "SIX"
+	default:
+		return fmt.Sprintf("LockMode(%d)", int(m))
 	}
-	return h.tx.Rollback()
 }
 
 type Manager struct {
-	db *sql.DB
+	db     *sql.DB
+	h      *Hierarchy
+	retry  *RetryPolicy
+	closed atomic.Bool
+
+	escalationThreshold int
+	onEscalation        func(EscalationEvent)
+
+	intentSlots int // intent rows per bucket; 0 disables intention locks
+	slotSeq     atomic.Uint32
+
+	global bool // every acquisition starts with the Global row
+
+	prevention      DeadlockPrevention
+	detectDeadlocks bool
+	txns            *txnRegistry // set when either of the above is enabled
+
+	order     *orderValidator // set by WithLockOrderValidator
+	lockClass func(level Level, id string) string
+}
+
+// ManagerOption configures a Manager.
+//
+// The other Lockers (MemoryLocker, NamedLocker, PostgresLocker,
+// RedisLocker) plan their acquisitions with a Manager as well and accept
+// the same options: WithHierarchy, WithIntentionLocks, WithGlobalLock,
+// WithEscalation and WithEscalationHook apply to them, and the others,
+// which concern the Manager's MySQL transactions, are ignored.
+type ManagerOption func(*Manager)
+
+// WithRetryPolicy makes Acquire and AcquireResources (and their TryAcquire
+// variants) retry according to p, each attempt in a fresh transaction.
+func WithRetryPolicy(p RetryPolicy) ManagerOption {
+	return func(m *Manager) {
+		m.retry = &p
+	}
+}
+
+// WithHierarchy makes the manager lock nodes of h instead of the default
+// User -> Account -> Resource hierarchy. The typed methods (Acquire,
+// AcquireResources, ...) then address the first three levels of h.
+func WithHierarchy(h *Hierarchy) ManagerOption {
+	return func(m *Manager) {
+		if h != nil {
+			m.h = h
+		}
+	}
+}
+
+// WithIntentionLocks enforces the full IS/IX/S/SIX/X compatibility matrix
+// (see Compatible) by also locking up to n intent rows per node in
+// hier_lock_intents, which must be provisioned with slots 0..n-1 for every
+// bucket row. Ancestors are then locked IS or IX instead of S. n <= 0 (the
+// default) disables intention locks; n is capped at 64.
+func WithIntentionLocks(n int) ManagerOption {
+	return func(m *Manager) {
+		m.intentSlots = min(max(n, 0), maxIntentSlots)
+	}
 }
 
-func NewManager(db *sql.DB) *Manager {
-	return &Manager{db: db}
+// WithGlobalLock makes every acquisition lock the Global row
+// (LevelGlobal, bucket 0) in shared mode (IS or IX with intention locks)
+// before anything else, so AcquireGlobal can drain and block all of them.
+// It costs one more lock statement per acquisition and is off by default.
+// Every manager working on the same tables must use it for AcquireGlobal to
+// be effective.
+func WithGlobalLock() ManagerOption {
+	return func(m *Manager) {
+		m.global = true
+	}
+}
+
+// WithDeadlockPrevention makes blocking acquisitions lock with NOWAIT
+// probes and resolve conflicts between the manager's own transactions with
+// the wait-die or wound-wait rule instead of InnoDB's deadlock detector. It
+// also lets AddResources lock out of (level, bucket) order. The TryAcquire
+// family, AcquireInTx and ClaimResources are unaffected. p == 0 (the
+// default) disables it.
+func WithDeadlockPrevention(p DeadlockPrevention) ManagerOption {
+	return func(m *Manager) {
+		m.prevention = 0
+		if p == WaitDie || p == WoundWait {
+			m.prevention = p
+		}
+	}
+}
+
+// WithDeadlockDetection makes the manager track which of its acquisitions
+// holds and waits for which row, and fail a blocking lock statement with a
+// *DeadlockError naming every participant when it would close a wait-for
+// cycle, instead of waiting for MySQL to pick a victim (1213). Only cycles
+// among the manager's own handles are seen; MySQL still resolves the rest.
+func WithDeadlockDetection() ManagerOption {
+	return func(m *Manager) {
+		m.detectDeadlocks = true
+	}
+}
+
+// WithEscalation sets the default escalation threshold for AcquireResources:
+// with more than n distinct resources, the Account is locked exclusively
+// instead of each resource. n <= 0 (the default) disables escalation.
+func WithEscalation(n int) ManagerOption {
+	return func(m *Manager) {
+		m.escalationThreshold = n
+	}
+}
+
+// WithEscalationHook registers fn to observe every AcquireResources call
+// that has an escalation threshold, whether or not it escalated.
+func WithEscalationHook(fn func(EscalationEvent)) ManagerOption {
+	return func(m *Manager) {
+		m.onEscalation = fn
+	}
+}
+
+// EscalationEvent describes one escalation decision.
+type EscalationEvent struct {
+	// Parent is the node whose children were requested; UserID and AccountID
+	// are its IDs when it is an Account of the default hierarchy.
+	Parent    Path
+	UserID    string
+	AccountID string
+	Resources int // distinct resources requested
+	Threshold int
+	Escalated bool
+}
+
+func NewManager(db *sql.DB, opts ...ManagerOption) *Manager {
+	m := &Manager{db: db, h: defaultHierarchy}
+	for _, opt := range opts {
+		if opt != nil {
+			opt(m)
+		}
+	}
+	if m.prevention != 0 || m.detectDeadlocks {
+		m.txns = newTxnRegistry(m.prevention)
+	}
+	return m
+}
+
+// Close stops the manager from starting new acquisitions; they fail with
+// ErrManagerClosed. Handles that are already held stay valid and must still
+// be released. The *sql.DB is owned by the caller and is not closed.
+func (m *Manager) Close() error {
+	if m != nil {
+		m.closed.Store(true)
+	}
+	return nil
+}
+
+// check reports whether the manager can start a new acquisition.
+func (m *Manager) check() error {
+	if m == nil || m.db == nil {
+		return invalidArgf("manager db is nil")
+	}
+	if m.closed.Load() {
+		return ErrManagerClosed
+	}
+	return nil
+}
+
+// Hierarchy returns the hierarchy the manager locks.
+func (m *Manager) Hierarchy() *Hierarchy {
+	return m.h
 }
 
 // Acquire locks the hierarchy using MySQL row locks.
 //
 // Rule:
 // - ancestors: shared lock (FOR SHARE)
-// - target: exclusive lock (FOR UPDATE)
+// - target: exclusive lock (FOR UPDATE), or shared lock with WithMode(ModeShared)
+//
+// Because ancestors are only ever locked FOR SHARE, a shared target does not
+// exclude writers of its descendants: Account(u1/a1) in ModeShared still allows
+// Resource(u1/a1/r1) in ModeExclusive.
 //
 // The locks are held until LockHandle.Release() (tx rollback).
-func (m *Manager) Acquire(ctx context.Context, level Level, userID, accountID, resourceID string) (*LockHandle, error) {
-	if m == nil || m.db == nil {
-		return nil, fmt.Errorf("manager db is nil")
+func (m *Manager) Acquire(ctx context.Context, level Level, userID, accountID, resourceID string, opts ...AcquireOption) (*LockHandle, error) {
+	cfg, err := newAcquireConfig(opts)
+	if err != nil {
+		return nil, err
 	}
-	keys, err := lockKeys(level, userID, accountID, resourceID)
+	path, err := typedPath(level, userID, accountID, resourceID)
 	if err != nil {
 		return nil, err
 	}
+	return m.acquirePath(ctx, path, cfg)
+}
 
-	tx, err := m.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelReadCommitted})
+// TryAcquire is like Acquire, but uses NOWAIT for every row. If any row is
+// already locked in a conflicting mode, the transaction is rolled back and
+// the returned error matches ErrWouldBlock; errors.As with *LockError reports
+// which (level, bucket) was busy.
+func (m *Manager) TryAcquire(ctx context.Context, level Level, userID, accountID, resourceID string, opts ...AcquireOption) (*LockHandle, error) {
+	cfg, err := newAcquireConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	cfg.wait = waitNoWait
+	path, err := typedPath(level, userID, accountID, resourceID)
 	if err != nil {
 		return nil, err
 	}
+	return m.acquirePath(ctx, path, cfg)
+}
 
-	// If anything fails, rollback to release any acquired locks.
-	rollback := func(cause error) (*LockHandle, error) {
-		_ = tx.Rollback()
-		return nil, cause
+// AcquirePath locks the node at path in the manager's hierarchy, at any
+// depth, with the same rule as Acquire: every ancestor shared, the node
+// itself exclusive (or shared with WithMode(ModeShared)).
+func (m *Manager) AcquirePath(ctx context.Context, path Path, opts ...AcquireOption) (*LockHandle, error) {
+	cfg, err := newAcquireConfig(opts)
+	if err != nil {
+		return nil, err
 	}
+	return m.acquirePath(ctx, path, cfg)
+}
 
-	// Acquire in strict ancestor->descendant order to avoid deadlocks.
-	for i, key := range keys {
-		isTarget := i == len(keys)-1
-		if err := lockRow(ctx, tx, key, isTarget); err != nil {
-			return rollback(err)
-		}
+// TryAcquirePath is the NOWAIT variant of AcquirePath. See TryAcquire.
+func (m *Manager) TryAcquirePath(ctx context.Context, path Path, opts ...AcquireOption) (*LockHandle, error) {
+	cfg, err := newAcquireConfig(opts)
+	if err != nil {
+		return nil, err
 	}
+	cfg.wait = waitNoWait
+	return m.acquirePath(ctx, path, cfg)
+}
 
-	return &LockHandle{tx: tx}, nil
+func (m *Manager) acquirePath(ctx context.Context, path Path, cfg acquireConfig) (*LockHandle, error) {
+	if err := m.check(); err != nil {
+		return nil, err
+	}
+	// Acquire in strict ancestor->descendant order to avoid deadlocks.
+	steps, err := m.pathSteps(path, cfg.mode)
+	if err != nil {
+		return nil, err
+	}
+	h, err := m.acquireSteps(ctx, steps, cfg)
+	if err != nil {
+		return nil, err
+	}
+	h.scope = m.h.scopeFor(path)
+	return h, nil
 }
 
 // AcquireResources locks a fixed hierarchy (User -> Account -> Resources...).
 //
 // Rule:
 // - User, Account: shared lock
-// - Each Resource: exclusive lock
+// - Each Resource: exclusive lock, or shared lock with WithMode(ModeShared)
 //
-// Resources are locked in lexicographical order to avoid deadlocks when multiple
-// transactions lock multiple resources.
-func (m *Manager) AcquireResources(ctx context.Context, userID, accountID string, resourceIDs []string) (*LockHandle, error) {
-	if m == nil || m.db == nil {
-		return nil, fmt.Errorf("manager db is nil")
+// Resources are locked in (level, bucket) order to avoid deadlocks when
+// multiple transactions lock multiple resources. IDs that share a bucket are
+// locked once and reported by LockHandle.Collisions.
+//
+// Escalation: with more distinct resources than the escalation threshold
+// (WithEscalation, WithEscalationThreshold), the Account is locked
+// exclusively instead of the individual resources, in any mode. This trades
+// concurrency on the Account for far fewer round trips and row locks;
+// LockHandle.Escalated reports it.
+func (m *Manager) AcquireResources(ctx context.Context, userID, accountID string, resourceIDs []string, opts ...AcquireOption) (*LockHandle, error) {
+	cfg, err := newAcquireConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	return m.acquireResources(ctx, userID, accountID, resourceIDs, cfg)
+}
+
+// TryAcquireResources is the NOWAIT variant of AcquireResources. See TryAcquire.
+func (m *Manager) TryAcquireResources(ctx context.Context, userID, accountID string, resourceIDs []string, opts ...AcquireOption) (*LockHandle, error) {
+	cfg, err := newAcquireConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	cfg.wait = waitNoWait
+	return m.acquireResources(ctx, userID, accountID, resourceIDs, cfg)
+}
+
+func (m *Manager) acquireResources(ctx context.Context, userID, accountID string, resourceIDs []string, cfg acquireConfig) (*LockHandle, error) {
+	if err := m.check(); err != nil {
+		return nil, err
+	}
+	if err := validateResources(userID, accountID, resourceIDs); err != nil {
+		return nil, err
+	}
+	return m.acquireChildren(ctx, Path{userID, accountID}, resourceIDs, cfg)
+}
+
+// AcquireAccounts locks several Accounts of one User, the way
+// AcquireResources locks several Resources of one Account.
+//
+// Rule:
+// - User: shared lock
+// - Each Account: exclusive lock, or shared lock with WithMode(ModeShared)
+//
+// Duplicate IDs are locked once, Accounts are locked in (level, bucket)
+// order, and IDs that share a bucket are reported by LockHandle.Collisions.
+// Escalation does not apply.
+func (m *Manager) AcquireAccounts(ctx context.Context, userID string, accountIDs []string, opts ...AcquireOption) (*LockHandle, error) {
+	cfg, err := newAcquireConfig(opts)
+	if err != nil {
+		return nil, err
 	}
+	return m.acquireAccounts(ctx, userID, accountIDs, cfg)
+}
+
+// TryAcquireAccounts is the NOWAIT variant of AcquireAccounts. See TryAcquire.
+func (m *Manager) TryAcquireAccounts(ctx context.Context, userID string, accountIDs []string, opts ...AcquireOption) (*LockHandle, error) {
+	cfg, err := newAcquireConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	cfg.wait = waitNoWait
+	return m.acquireAccounts(ctx, userID, accountIDs, cfg)
+}
+
+func (m *Manager) acquireAccounts(ctx context.Context, userID string, accountIDs []string, cfg acquireConfig) (*LockHandle, error) {
+	if err := m.check(); err != nil {
+		return nil, err
+	}
+	if err := validateAccounts(userID, accountIDs); err != nil {
+		return nil, err
+	}
+	return m.acquireChildren(ctx, Path{userID}, accountIDs, cfg)
+}
+
+func validateResources(userID, accountID string, resourceIDs []string) error {
 	if userID == "" || accountID == "" {
-		return nil, fmt.Errorf("userID and accountID are required")
+		return invalidArgf("userID and accountID are required")
 	}
 	if len(resourceIDs) == 0 {
-		return nil, fmt.Errorf("resourceIDs is required")
+		return invalidArgf("resourceIDs is required")
 	}
 	for _, r := range resourceIDs {
 		if r == "" {
-			return nil, fmt.Errorf("resourceID is required")
+			return invalidArgf("resourceID is required")
+		}
+	}
+	return nil
+}
+
+func validateAccounts(userID string, accountIDs []string) error {
+	if userID == "" {
+		return invalidArgf("userID is required")
+	}
+	if len(accountIDs) == 0 {
+		return invalidArgf("accountIDs is required")
+	}
+	for _, a := range accountIDs {
+		if a == "" {
+			return invalidArgf("accountID is required")
 		}
 	}
+	return nil
+}
 
-	tx, err := m.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelReadCommitted})
+// acquireChildren locks parent's ancestors and parent shared and the given
+// children of parent in mode, in (level, bucket) order. childIDs must be
+// non-empty and contain no empty ID.
+func (m *Manager) acquireChildren(ctx context.Context, parent Path, childIDs []string, cfg acquireConfig) (*LockHandle, error) {
+	steps, collisions, scope, err := m.childSteps(parent, childIDs, cfg)
+	if err != nil {
+		return nil, err
+	}
+	h, err := m.acquireSteps(ctx, steps, cfg)
 	if err != nil {
 		return nil, err
 	}
+	h.collisions, h.scope = collisions, scope
+	return h, nil
+}
 
-	rollback := func(cause error) (*LockHandle, error) {
-		_ = tx.Rollback()
-		return nil, cause
+// childSteps plans acquireChildren: the steps in lock order, the bucket
+// collisions among the children, and the handle's scope (nil unless the
+// children are leaves).
+func (m *Manager) childSteps(parent Path, childIDs []string, cfg acquireConfig) ([]lockStep, []BucketCollision, *leafScope, error) {
+	if err := m.h.validateParent(parent); err != nil {
+		return nil, nil, nil, err
 	}
 
-	// Shared locks on ancestors.
-	if err := lockRow(ctx, tx, userTarget(userID), false); err != nil {
-		return rollback(err)
+	ordered := append([]string{}, childIDs...)
+	sort.Strings(ordered)
+	ordered = slices.Compact(ordered)
+
+	steps, err := m.parentSteps(parent, cfg.mode)
+	if err != nil {
+		return nil, nil, nil, err
 	}
-	if err := lockRow(ctx, tx, accountTarget(userID, accountID), false); err != nil {
-		return rollback(err)
+
+	m.assignSlots(steps, m.nextSlot())
+
+	// Escalation only replaces leaves (Resources) by their parent, which is
+	// then exclusive whatever the mode, so its ancestors announce it.
+	if len(parent) == m.h.Depth()-1 && m.escalate(parent, len(ordered), cfg) {
+		am := m.ancestorMode(ModeExclusive)
+		for i := range steps[:len(steps)-1] {
+			steps[i].mode = am
+		}
+		steps[len(steps)-1].mode = ModeExclusive
+		steps[len(steps)-1].requested = true
+		return steps, nil, &leafScope{parent: parent, children: ordered, escalated: true}, nil
 	}
 
-	// Exclusive locks on resources in deterministic order.
-	ordered := append([]string{}, resourceIDs...)
-	sort.Strings(ordered)
-	for _, r := range ordered {
-		if err := lockRow(ctx, tx, resourceTarget(userID, accountID, r), true); err != nil {
-			return rollback(err)
+	// Target locks on children in deterministic order.
+	for _, id := range ordered {
+		steps = append(steps, m.step(parent.child(id), cfg.mode, true))
+	}
+	steps, collisions := planSteps(steps)
+	var scope *leafScope
+	if len(parent) == m.h.Depth()-1 {
+		scope = &leafScope{parent: parent, children: ordered}
+	}
+	return steps, collisions, scope, nil
+}
+
+// escalate decides whether n children of parent should be replaced by an
+// exclusive lock on parent, and reports the decision to the hook.
+func (m *Manager) escalate(parent Path, n int, cfg acquireConfig) bool {
+	threshold := m.escalationThreshold
+	if cfg.escalationSet {
+		threshold = cfg.escalationThreshold
+	}
+	if threshold <= 0 {
+		return false
+	}
+	escalated := n > threshold
+	if m.onEscalation != nil {
+		ev := EscalationEvent{Parent: parent, Resources: n, Threshold: threshold, Escalated: escalated}
+		if m.h == defaultHierarchy {
+			ev.UserID, ev.AccountID = parent[0], parent[1]
 		}
+		m.onEscalation(ev)
 	}
+	return escalated
+}
 
-	return &LockHandle{tx: tx}, nil
+// acquireSteps begins the lock transaction and locks steps in order, retrying
+// with a fresh transaction according to the manager's RetryPolicy.
+func (m *Manager) acquireSteps(ctx context.Context, steps []lockStep, cfg acquireConfig) (*LockHandle, error) {
+	if cfg.wait == waitBlock {
+		m.checkOrder(ctx, steps)
+	}
+	h, err := m.acquireStepsRetried(ctx, steps, cfg)
+	if err != nil {
+		return nil, err
+	}
+	m.holdOrder(ctx, h)
+	return h, nil
+}
+
+func (m *Manager) acquireStepsRetried(ctx context.Context, steps []lockStep, cfg acquireConfig) (*LockHandle, error) {
+	once := m.acquireStepsOnce
+	switch {
+	case m.txns == nil:
+	case m.prevention != 0:
+		if cfg.wait == waitBlock {
+			once = m.acquireStepsPrevented
+		}
+	default:
+		// Try acquisitions are tracked too: they never wait, but others may
+		// wait for the rows they hold.
+		once = m.acquireStepsTracked
+	}
+	if m.retry == nil {
+		return once(ctx, steps, cfg)
+	}
+	var h *LockHandle
+	err := m.retry.Do(ctx, func(ctx context.Context) error {
+		var err error
+		h, err = once(ctx, steps, cfg)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// acquireStepsOnce makes a single attempt. If anything fails, the transaction
+// is rolled back to release any acquired locks.
+func (m *Manager) acquireStepsOnce(ctx context.Context, steps []lockStep, cfg acquireConfig) (*LockHandle, error) {
+	conn, tx, err := m.beginLockTx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockSteps(ctx, tx, steps, cfg); err != nil {
+		_ = tx.Rollback()
+		closeLockConn(conn, errors.Is(err, errLockWaitNotReset))
+		cfg.txn.end()
+		return nil, err
+	}
+	return &LockHandle{conn: conn, tx: tx, m: m, steps: steps, cfg: cfg}, nil
+}
+
+// beginLockTx begins a lock transaction on a connection of its own, so that
+// the connection can be discarded if its session cannot be reset.
+func (m *Manager) beginLockTx(ctx context.Context) (*sql.Conn, *sql.Tx, error) {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	tx, err := conn.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelReadCommitted})
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+	return conn, tx, nil
+}
+
+// closeLockConn returns conn to the pool once its transaction has ended. With
+// discard set, the connection is closed instead, ending the session and any
+// setting left on it.
+func closeLockConn(conn *sql.Conn, discard bool) {
+	if conn == nil {
+		return
+	}
+	if discard {
+		_ = conn.Raw(func(any) error { return driver.ErrBadConn })
+	}
+	_ = conn.Close()
 }
 
 type lockTarget struct {
@@ -136,38 +607,133 @@ type lockTarget struct {
 	bucket int
 }
 
-func lockKeys(level Level, userID, accountID, resourceID string) ([]lockTarget, error) {
+// lockStep is one node lock of an acquisition: its bucket row and, with
+// intention locks, its intent rows.
+type lockStep struct {
+	target    lockTarget
+	mode      LockMode
+	requested bool   // a target the caller asked for, as opposed to an implied ancestor
+	name      string // hierarchy path for errors, e.g. "Account(u1/a1)"
+	path      Path
+
+	slots int // intent rows per bucket; 0 when intention locks are off
+	slot  int // the intent row IX and SIX lock exclusively
+}
+
+// id returns the node's own ID, the last element of its path.
+func (st lockStep) id() string {
+	if len(st.path) == 0 {
+		return ""
+	}
+	return st.path[len(st.path)-1]
+}
+
+// pathSteps returns the steps for the node at path: ancestors in
+// ancestorMode(mode), the node itself in mode.
+func (m *Manager) pathSteps(path Path, mode LockMode) ([]lockStep, error) {
+	steps, err := m.h.pathSteps(path, mode, m.ancestorMode(mode))
+	if err != nil {
+		return nil, err
+	}
+	steps = m.withGlobal(steps, m.ancestorMode(mode))
+	m.assignSlots(steps, m.nextSlot())
+	return steps, nil
+}
+
+// parentSteps returns the steps for parent and its ancestors ahead of
+// locking children of parent in mode. None of them is requested; the caller
+// assigns intent slots once it knows the children.
+func (m *Manager) parentSteps(parent Path, mode LockMode) ([]lockStep, error) {
+	am := m.ancestorMode(mode)
+	steps, err := m.h.pathSteps(parent, am, am)
+	if err != nil {
+		return nil, err
+	}
+	steps[len(steps)-1].requested = false
+	return m.withGlobal(steps, am), nil
+}
+
+// step returns the step for the node at path on its own. path must be valid.
+func (m *Manager) step(path Path, mode LockMode, requested bool) lockStep {
+	st := m.h.step(path, mode, requested)
+	if m.intentSlots > 0 {
+		st.slots, st.slot = m.intentSlots, m.nextSlot()
+	}
+	return st
+}
+
+// ancestorMode returns the mode ancestors of a target locked in mode take.
+func (m *Manager) ancestorMode(mode LockMode) LockMode {
+	if m.intentSlots == 0 {
+		return ModeShared
+	}
+	return intentionMode(mode)
+}
+
+// nextSlot picks the intent row for an acquisition, round-robin.
+func (m *Manager) nextSlot() int {
+	if m.intentSlots == 0 {
+		return 0
+	}
+	return int(m.slotSeq.Add(1) % uint32(m.intentSlots))
+}
+
+// assignSlots makes steps use intent row slot.
+func (m *Manager) assignSlots(steps []lockStep, slot int) {
+	if m.intentSlots == 0 {
+		return
+	}
+	for i := range steps {
+		steps[i].slots, steps[i].slot = m.intentSlots, slot
+	}
+}
+
+// typedPath converts the arguments of the typed three-level methods to a
+// Path. IDs below level are ignored.
+func typedPath(level Level, userID, accountID, resourceID string) (Path, error) {
 	switch level {
 	case LevelUser:
 		if userID == "" {
-			return nil, fmt.Errorf("userID is required")
+			return nil, invalidArgf("userID is required")
 		}
-		return []lockTarget{userTarget(userID)}, nil
+		return Path{userID}, nil
 	case LevelAccount:
 		if userID == "" || accountID == "" {
-			return nil, fmt.Errorf("userID and accountID are required")
+			return nil, invalidArgf("userID and accountID are required")
 		}
-		return []lockTarget{userTarget(userID), accountTarget(userID, accountID)}, nil
+		return Path{userID, accountID}, nil
 	case LevelResource:
 		if userID == "" || accountID == "" || resourceID == "" {
-			return nil, fmt.Errorf("userID, accountID, and resourceID are required")
+			return nil, invalidArgf("userID, accountID, and resourceID are required")
 		}
-		return []lockTarget{userTarget(userID), accountTarget(userID, accountID), resourceTarget(userID, accountID, resourceID)}, nil
+		return Path{userID, accountID, resourceID}, nil
 	default:
-		return nil, fmt.Errorf("unknown level")
+		return nil, invalidArgf("unknown level")
+	}
+}
+
+func lockKeys(level Level, userID, accountID, resourceID string) ([]lockTarget, error) {
+	path, err := typedPath(level, userID, accountID, resourceID)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]lockTarget, 0, len(path))
+	for i := range path {
+		keys = append(keys, defaultHierarchy.target(path[:i+1]))
 	}
+	return keys, nil
 }
 
 func userTarget(userID string) lockTarget {
-	return lockTarget{level: LevelUser, bucket: bucket("user:", userID)}
+	return defaultHierarchy.target(Path{userID})
 }
 
 func accountTarget(userID, accountID string) lockTarget {
-	return lockTarget{level: LevelAccount, bucket: bucket("account:", userID+":"+accountID)}
+	return defaultHierarchy.target(Path{userID, accountID})
 }
 
 func resourceTarget(userID, accountID, resourceID string) lockTarget {
-	return lockTarget{level: LevelResource, bucket: bucket("resource:", userID+":"+accountID+":"+resourceID)}
+	return defaultHierarchy.target(Path{userID, accountID, resourceID})
 }
 
 func bucket(prefix, s string) int {
@@ -177,21 +743,121 @@ func bucket(prefix, s string) int {
 	return int(h.Sum32() % lockBucketSpace)
 }
 
+// lockSteps locks steps in order on tx, applying the configured
+// innodb_lock_wait_timeout before each statement. The session value is put
+// back to the server default before returning, even if ctx is done, so it
+// does not leak into later statements. If that fails the error matches
+// errLockWaitNotReset and the connection must be discarded rather than
+// pooled (see closeLockConn). Under deadlock prevention the steps are probed
+// instead (see txn.lockSteps); under deadlock detection each blocking
+// statement is first checked against the wait-for graph.
+func lockSteps(ctx context.Context, tx *sql.Tx, steps []lockStep, cfg acquireConfig) (err error) {
+	if cfg.txn != nil && cfg.wait == waitBlock && cfg.txn.reg.policy != 0 {
+		return cfg.txn.lockSteps(ctx, tx, steps, cfg)
+	}
+	var session lockWaitSession
+	defer func() {
+		if rerr := session.reset(ctx, tx); rerr != nil {
+			err = errors.Join(err, rerr)
+		}
+	}()
+	for _, st := range steps {
+		if err := session.apply(ctx, tx, cfg.lockWaitSeconds(ctx, st.target.level)); err != nil {
+			return err
+		}
+		if cfg.wait == waitBlock {
+			if err := cfg.txn.waitFor(st); err != nil {
+				return err
+			}
+		}
+		err := lockStepRow(ctx, tx, st, cfg.wait)
+		cfg.txn.granted(st, err == nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lockWaitResetTimeout bounds putting innodb_lock_wait_timeout back.
+const lockWaitResetTimeout = 5 * time.Second
+
+// errLockWaitNotReset marks a failure to put innodb_lock_wait_timeout back
+// to the server default; the connection still has the shortened value.
+var errLockWaitNotReset = errors.New("hierlock: innodb_lock_wait_timeout not reset")
+
+// lockWaitSession tracks the innodb_lock_wait_timeout set on a transaction's
+// session so that SET is only issued when the value changes.
+type lockWaitSession struct {
+	seconds int // 0 means the server default
+}
+
+// reset puts the session value back to the server default. It runs without
+// ctx's cancellation, which may be what ended the wait, bounded by
+// lockWaitResetTimeout.
+func (s *lockWaitSession) reset(ctx context.Context, tx *sql.Tx) error {
+	if s.seconds == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), lockWaitResetTimeout)
+	defer cancel()
+	if err := s.apply(ctx, tx, 0); err != nil {
+		return fmt.Errorf("%w: %w", errLockWaitNotReset, err)
+	}
+	return nil
+}
+
+func (s *lockWaitSession) apply(ctx context.Context, tx *sql.Tx, seconds int) error {
+	if s.seconds == seconds {
+		return nil
+	}
+	var err error
+	if seconds == 0 {
+		_, err = tx.ExecContext(ctx, "SET SESSION innodb_lock_wait_timeout = DEFAULT")
+	} else {
+		_, err = tx.ExecContext(ctx, fmt.Sprintf("SET SESSION innodb_lock_wait_timeout = %d", seconds))
+	}
+	if err != nil {
+		return fmt.Errorf("set innodb_lock_wait_timeout=%d: %w", seconds, err)
+	}
+	s.seconds = seconds
+	return nil
+}
+
 func lockRow(ctx context.Context, tx *sql.Tx, target lockTarget, exclusive bool) error {
+	mode := ModeShared
+	if exclusive {
+		mode = ModeExclusive
+	}
+	return lockStepRow(ctx, tx, lockStep{target: target, mode: mode}, waitBlock)
+}
+
+// lockStepRow locks the bucket row of st and then its intent rows, if any.
+func lockStepRow(ctx context.Context, tx *sql.Tx, st lockStep, wait waitPolicy) error {
+	if err := lockBucketRow(ctx, tx, st, st.bucketExclusive(), wait); err != nil {
+		return err
+	}
+	return lockIntentRows(ctx, tx, st, wait)
+}
+
+func lockBucketRow(ctx context.Context, tx *sql.Tx, st lockStep, exclusive bool, wait waitPolicy) error {
 	// NOTE:
-	// - We intentionally DO NOT use NOWAIT here: callers/tests can observe real
-	//   blocking behavior.
+	// - NOWAIT is only used by the TryAcquire family; by default callers/tests
+	//   can observe real blocking behavior.
 	// - The row must exist (bucket rows are expected to be pre-provisioned).
-	var query string
+	query := "SELECT bucket FROM hier_lock_buckets WHERE level = ? AND bucket = ?"
 	if exclusive {
-		query = "SELECT bucket FROM hier_lock_buckets WHERE level = ? AND bucket = ? FOR UPDATE"
+		query += " FOR UPDATE"
 	} else {
-		query = "SELECT bucket FROM hier_lock_buckets WHERE level = ? AND bucket = ? FOR SHARE"
+		query += " FOR SHARE"
+	}
+	if wait == waitNoWait {
+		query += " NOWAIT"
 	}
 
 	var got int
-	if err := tx.QueryRowContext(ctx, query, int(target.level), target.bucket).Scan(&got); err != nil {
-		return fmt.Errorf("lock level=%d bucket=%d (exclusive=%v): %w", target.level, target.bucket, exclusive, err)
+	if err := tx.QueryRowContext(ctx, query, int(st.target.level), st.target.bucket).Scan(&got); err != nil {
+		return &LockError{Target: st.name, Level: st.target.level, Bucket: st.target.bucket, Exclusive: exclusive, Cause: err}
 	}
 	return nil
 }
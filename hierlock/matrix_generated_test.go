@@ -11,11 +11,10 @@ import (
 // We generate many (first, second) combinations and validate whether the second
 // acquisition blocks or not while the first is held.
 func TestHierarchy_ExhaustiveGeneratedMatrix(t *testing.T) {
-	db, cleanup := openTestDB(t)
-	defer cleanup()
-
-	m := NewManager(db)
+	forEachBackend(t, testExhaustiveGeneratedMatrix)
+}
 
+func testExhaustiveGeneratedMatrix(t *testing.T, b testBackend) {
 	u1 := "u1"
 	a1 := "a1"
 	r1 := "r1"
@@ -82,10 +81,15 @@ func TestHierarchy_ExhaustiveGeneratedMatrix(t *testing.T) {
 			}
 		}
 	}
+	// Shared-target variants of every spec.
+	for _, s := range specs {
+		s.mode = ModeShared
+		specs = append(specs, s)
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
 	defer cancel()
-	setupLockTable(ctx, t, db)
+	b.reset(ctx, t)
 
 	// Pre-provision bucket rows required by all specs.
 	need := map[lockTarget]struct{}{}
@@ -98,7 +102,7 @@ func TestHierarchy_ExhaustiveGeneratedMatrix(t *testing.T) {
 	for tgt := range need {
 		flat = append(flat, tgt)
 	}
-	seedBuckets(ctx, t, db, flat...)
+	b.provision(ctx, t, flat...)
 
 	for _, first := range specs {
 		for _, second := range specs {
@@ -112,17 +116,17 @@ func TestHierarchy_ExhaustiveGeneratedMatrix(t *testing.T) {
 				caseCtx, caseCancel := context.WithTimeout(context.Background(), 8*time.Second)
 				defer caseCancel()
 
-				h1, err := m.Acquire(caseCtx, first.level, first.userID, first.accountID, first.resourceID)
+				h1, err := b.Acquire(caseCtx, first.level, first.userID, first.accountID, first.resourceID, WithMode(first.mode))
 				if err != nil {
 					t.Fatalf("first acquire: %v", err)
 				}
 				defer h1.Release()
 
 				done := make(chan struct{})
-				var h2 *LockHandle
+				var h2 Handle
 				var err2 error
 				go func() {
-					h2, err2 = m.Acquire(caseCtx, second.level, second.userID, second.accountID, second.resourceID)
+					h2, err2 = b.Acquire(caseCtx, second.level, second.userID, second.accountID, second.resourceID, WithMode(second.mode))
 					close(done)
 				}()
 
@@ -171,11 +175,11 @@ func TestHierarchy_ExhaustiveGeneratedMatrix(t *testing.T) {
 func specName(s acquireSpec) string {
 	switch s.level {
 	case LevelUser:
-		return fmt.Sprintf("User(%s)", s.userID)
+		return fmt.Sprintf("User(%s)[%v]", s.userID, s.mode)
 	case LevelAccount:
-		return fmt.Sprintf("Account(%s/%s)", s.userID, s.accountID)
+		return fmt.Sprintf("Account(%s/%s)[%v]", s.userID, s.accountID, s.mode)
 	case LevelResource:
-		return fmt.Sprintf("Resource(%s/%s/%s)", s.userID, s.accountID, s.resourceID)
+		return fmt.Sprintf("Resource(%s/%s/%s)[%v]", s.userID, s.accountID, s.resourceID, s.mode)
 	default:
 		return "Unknown"
 	}
@@ -206,7 +210,7 @@ func lockIntent(s acquireSpec) map[string]lockMode {
 	keys := mustKeys(s.level, s.userID, s.accountID, s.resourceID)
 	m := make(map[string]lockMode, len(keys))
 	for i, k := range keys {
-		if i == len(keys)-1 {
+		if i == len(keys)-1 && s.mode == ModeExclusive {
 			m[k] = lockExclusive
 		} else {
 			m[k] = lockShared
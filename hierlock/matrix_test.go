@@ -2,6 +2,8 @@ package hierlock
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"testing"
 	"time"
 )
@@ -11,14 +13,14 @@ type acquireSpec struct {
 	userID     string
 	accountID  string
 	resourceID string
+	mode       LockMode
 }
 
 func TestHierarchy_CompatibilityMatrix(t *testing.T) {
-	db, cleanup := openTestDB(t)
-	defer cleanup()
-
-	m := NewManager(db)
+	forEachBackend(t, testCompatibilityMatrix)
+}
 
+func testCompatibilityMatrix(t *testing.T, b testBackend) {
 	u1 := "u1"
 	a1 := "a1"
 	r1 := "r1"
@@ -27,83 +29,145 @@ func TestHierarchy_CompatibilityMatrix(t *testing.T) {
 	u2 := pickDifferentUserIDNonColliding(u1, a1, r1)
 
 	cases := []struct {
-		name         string
-		first        acquireSpec
-		second       acquireSpec
+		name      string
+		first     acquireSpec
+		second    acquireSpec
 		wantBlock bool
 	}{
 		{
-			name: "resource blocks same resource",
-			first: acquireSpec{level: LevelResource, userID: u1, accountID: a1, resourceID: r1},
-			second: acquireSpec{level: LevelResource, userID: u1, accountID: a1, resourceID: r1},
+			name:      "resource blocks same resource",
+			first:     acquireSpec{level: LevelResource, userID: u1, accountID: a1, resourceID: r1},
+			second:    acquireSpec{level: LevelResource, userID: u1, accountID: a1, resourceID: r1},
 			wantBlock: true,
 		},
 		{
-			name: "resource allows different resource same account",
-			first: acquireSpec{level: LevelResource, userID: u1, accountID: a1, resourceID: r1},
-			second: acquireSpec{level: LevelResource, userID: u1, accountID: a1, resourceID: r2},
+			name:      "resource allows different resource same account",
+			first:     acquireSpec{level: LevelResource, userID: u1, accountID: a1, resourceID: r1},
+			second:    acquireSpec{level: LevelResource, userID: u1, accountID: a1, resourceID: r2},
 			wantBlock: false,
 		},
 		{
-			name: "resource allows different account same user",
-			first: acquireSpec{level: LevelResource, userID: u1, accountID: a1, resourceID: r1},
-			second: acquireSpec{level: LevelResource, userID: u1, accountID: a2, resourceID: r1},
+			name:      "resource allows different account same user",
+			first:     acquireSpec{level: LevelResource, userID: u1, accountID: a1, resourceID: r1},
+			second:    acquireSpec{level: LevelResource, userID: u1, accountID: a2, resourceID: r1},
 			wantBlock: false,
 		},
 		{
-			name: "resource allows different user",
-			first: acquireSpec{level: LevelResource, userID: u1, accountID: a1, resourceID: r1},
-			second: acquireSpec{level: LevelResource, userID: u2, accountID: a1, resourceID: r1},
+			name:      "resource allows different user",
+			first:     acquireSpec{level: LevelResource, userID: u1, accountID: a1, resourceID: r1},
+			second:    acquireSpec{level: LevelResource, userID: u2, accountID: a1, resourceID: r1},
+			wantBlock: false,
+		},
+		{
+			name:      "account blocks resource under same account",
+			first:     acquireSpec{level: LevelAccount, userID: u1, accountID: a1},
+			second:    acquireSpec{level: LevelResource, userID: u1, accountID: a1, resourceID: r1},
+			wantBlock: true,
+		},
+		{
+			name:      "resource blocks account on same account",
+			first:     acquireSpec{level: LevelResource, userID: u1, accountID: a1, resourceID: r1},
+			second:    acquireSpec{level: LevelAccount, userID: u1, accountID: a1},
+			wantBlock: true,
+		},
+		{
+			name:      "account blocks same account",
+			first:     acquireSpec{level: LevelAccount, userID: u1, accountID: a1},
+			second:    acquireSpec{level: LevelAccount, userID: u1, accountID: a1},
+			wantBlock: true,
+		},
+		{
+			name:      "account allows different account under same user",
+			first:     acquireSpec{level: LevelAccount, userID: u1, accountID: a1},
+			second:    acquireSpec{level: LevelAccount, userID: u1, accountID: a2},
 			wantBlock: false,
 		},
 		{
-			name: "account blocks resource under same account",
-			first: acquireSpec{level: LevelAccount, userID: u1, accountID: a1},
-			second: acquireSpec{level: LevelResource, userID: u1, accountID: a1, resourceID: r1},
+			name:      "user blocks account under same user",
+			first:     acquireSpec{level: LevelUser, userID: u1},
+			second:    acquireSpec{level: LevelAccount, userID: u1, accountID: a1},
 			wantBlock: true,
 		},
 		{
-			name: "resource blocks account on same account",
-			first: acquireSpec{level: LevelResource, userID: u1, accountID: a1, resourceID: r1},
-			second: acquireSpec{level: LevelAccount, userID: u1, accountID: a1},
+			name:      "account blocks user (reverse order)",
+			first:     acquireSpec{level: LevelAccount, userID: u1, accountID: a1},
+			second:    acquireSpec{level: LevelUser, userID: u1},
 			wantBlock: true,
 		},
 		{
-			name: "account blocks same account",
-			first: acquireSpec{level: LevelAccount, userID: u1, accountID: a1},
-			second: acquireSpec{level: LevelAccount, userID: u1, accountID: a1},
+			name:      "user blocks resource under same user",
+			first:     acquireSpec{level: LevelUser, userID: u1},
+			second:    acquireSpec{level: LevelResource, userID: u1, accountID: a1, resourceID: r1},
 			wantBlock: true,
 		},
 		{
-			name: "account allows different account under same user",
-			first: acquireSpec{level: LevelAccount, userID: u1, accountID: a1},
-			second: acquireSpec{level: LevelAccount, userID: u1, accountID: a2},
+			name:      "user allows different user",
+			first:     acquireSpec{level: LevelUser, userID: u1},
+			second:    acquireSpec{level: LevelUser, userID: u2},
 			wantBlock: false,
 		},
 		{
-			name: "user blocks account under same user",
-			first: acquireSpec{level: LevelUser, userID: u1},
-			second: acquireSpec{level: LevelAccount, userID: u1, accountID: a1},
+			name:      "shared account allows shared account (S vs S)",
+			first:     acquireSpec{level: LevelAccount, userID: u1, accountID: a1, mode: ModeShared},
+			second:    acquireSpec{level: LevelAccount, userID: u1, accountID: a1, mode: ModeShared},
+			wantBlock: false,
+		},
+		{
+			name:      "shared account blocks exclusive account (S vs X)",
+			first:     acquireSpec{level: LevelAccount, userID: u1, accountID: a1, mode: ModeShared},
+			second:    acquireSpec{level: LevelAccount, userID: u1, accountID: a1},
+			wantBlock: true,
+		},
+		{
+			name:      "exclusive account blocks shared account (X vs S)",
+			first:     acquireSpec{level: LevelAccount, userID: u1, accountID: a1},
+			second:    acquireSpec{level: LevelAccount, userID: u1, accountID: a1, mode: ModeShared},
+			wantBlock: true,
+		},
+		{
+			name:      "shared resource allows shared resource (S vs S)",
+			first:     acquireSpec{level: LevelResource, userID: u1, accountID: a1, resourceID: r1, mode: ModeShared},
+			second:    acquireSpec{level: LevelResource, userID: u1, accountID: a1, resourceID: r1, mode: ModeShared},
+			wantBlock: false,
+		},
+		{
+			name:      "shared resource blocks exclusive resource (S vs X)",
+			first:     acquireSpec{level: LevelResource, userID: u1, accountID: a1, resourceID: r1, mode: ModeShared},
+			second:    acquireSpec{level: LevelResource, userID: u1, accountID: a1, resourceID: r1},
 			wantBlock: true,
 		},
 		{
-			name: "account blocks user (reverse order)",
-			first: acquireSpec{level: LevelAccount, userID: u1, accountID: a1},
-			second: acquireSpec{level: LevelUser, userID: u1},
+			name:      "exclusive account blocks shared resource under it (S under X)",
+			first:     acquireSpec{level: LevelAccount, userID: u1, accountID: a1},
+			second:    acquireSpec{level: LevelResource, userID: u1, accountID: a1, resourceID: r1, mode: ModeShared},
 			wantBlock: true,
 		},
 		{
-			name: "user blocks resource under same user",
-			first: acquireSpec{level: LevelUser, userID: u1},
-			second: acquireSpec{level: LevelResource, userID: u1, accountID: a1, resourceID: r1},
+			name:      "exclusive user blocks shared account under it (S under X)",
+			first:     acquireSpec{level: LevelUser, userID: u1},
+			second:    acquireSpec{level: LevelAccount, userID: u1, accountID: a1, mode: ModeShared},
 			wantBlock: true,
 		},
 		{
-			name: "user allows different user",
-			first: acquireSpec{level: LevelUser, userID: u1},
-			second: acquireSpec{level: LevelUser, userID: u2},
+			name:      "shared account allows shared resource under it",
+			first:     acquireSpec{level: LevelAccount, userID: u1, accountID: a1, mode: ModeShared},
+			second:    acquireSpec{level: LevelResource, userID: u1, accountID: a1, resourceID: r1, mode: ModeShared},
+			wantBlock: false,
+		},
+		{
+			// Ancestors are only locked FOR SHARE, so a shared Account does not
+			// exclude writers of its resources.
+			name:      "shared account allows exclusive resource under it",
+			first:     acquireSpec{level: LevelAccount, userID: u1, accountID: a1, mode: ModeShared},
+			second:    acquireSpec{level: LevelResource, userID: u1, accountID: a1, resourceID: r1},
 			wantBlock: false,
 		},
+		{
+			name:      "shared resource blocks exclusive account above it",
+			first:     acquireSpec{level: LevelResource, userID: u1, accountID: a1, resourceID: r1, mode: ModeShared},
+			second:    acquireSpec{level: LevelAccount, userID: u1, accountID: a1},
+			wantBlock: true,
+		},
 	}
 
 	for _, tc := range cases {
@@ -112,7 +176,7 @@ func TestHierarchy_CompatibilityMatrix(t *testing.T) {
 			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 			defer cancel()
 
-			setupLockTable(ctx, t, db)
+			b.reset(ctx, t)
 			// Pre-provision bucket rows required by both acquisitions.
 			need := map[lockTarget]struct{}{}
 			for _, spec := range []acquireSpec{tc.first, tc.second} {
@@ -125,19 +189,19 @@ func TestHierarchy_CompatibilityMatrix(t *testing.T) {
 			for tgt := range need {
 				flat = append(flat, tgt)
 			}
-			seedBuckets(ctx, t, db, flat...)
+			b.provision(ctx, t, flat...)
 
-			first, err := m.Acquire(ctx, tc.first.level, tc.first.userID, tc.first.accountID, tc.first.resourceID)
+			first, err := b.Acquire(ctx, tc.first.level, tc.first.userID, tc.first.accountID, tc.first.resourceID, WithMode(tc.first.mode))
 			if err != nil {
 				t.Fatalf("first acquire: %v", err)
 			}
 			defer first.Release()
 
 			done := make(chan struct{})
-			var secondHandle *LockHandle
+			var secondHandle Handle
 			var secondErr error
 			go func() {
-				secondHandle, secondErr = m.Acquire(ctx, tc.second.level, tc.second.userID, tc.second.accountID, tc.second.resourceID)
+				secondHandle, secondErr = b.Acquire(ctx, tc.second.level, tc.second.userID, tc.second.accountID, tc.second.resourceID, WithMode(tc.second.mode))
 				close(done)
 			}()
 
@@ -181,29 +245,28 @@ func TestHierarchy_CompatibilityMatrix(t *testing.T) {
 }
 
 func TestHierarchy_NoDeadlock_MultiResourceOrdered(t *testing.T) {
-	db, cleanup := openTestDB(t)
-	defer cleanup()
+	forEachBackend(t, testNoDeadlockMultiResourceOrdered)
+}
 
+func testNoDeadlockMultiResourceOrdered(t *testing.T, b testBackend) {
 	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
 	defer cancel()
-	setupLockTable(ctx, t, db)
-	seedBuckets(ctx, t, db,
+	b.reset(ctx, t)
+	b.provision(ctx, t,
 		userTarget("u1"),
 		accountTarget("u1", "a1"),
 		resourceTarget("u1", "a1", "r1"),
 		resourceTarget("u1", "a1", "r2"),
 	)
 
-	m := NewManager(db)
-
-	first, err := m.AcquireResources(ctx, "u1", "a1", []string{"r1", "r2"})
+	first, err := b.AcquireResources(ctx, "u1", "a1", []string{"r1", "r2"})
 	if err != nil {
 		t.Fatalf("first AcquireResources: %v", err)
 	}
 
 	done := make(chan error, 1)
 	go func() {
-		second, err := m.AcquireResources(ctx, "u1", "a1", []string{"r2", "r1"}) // reversed input
+		second, err := b.AcquireResources(ctx, "u1", "a1", []string{"r2", "r1"}) // reversed input
 		if second != nil {
 			defer second.Release()
 		}
@@ -236,3 +299,163 @@ func TestHierarchy_NoDeadlock_MultiResourceOrdered(t *testing.T) {
 	}
 }
 
+func TestHierarchy_SharedMultiResourceCoexist(t *testing.T) {
+	forEachBackend(t, testSharedMultiResourceCoexist)
+}
+
+func testSharedMultiResourceCoexist(t *testing.T, b testBackend) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	b.reset(ctx, t)
+	r2 := pickDifferentResourceID("u1", "a1", "r1")
+	b.provision(ctx, t,
+		userTarget("u1"),
+		accountTarget("u1", "a1"),
+		resourceTarget("u1", "a1", "r1"),
+		resourceTarget("u1", "a1", r2),
+	)
+
+	first, err := b.AcquireResources(ctx, "u1", "a1", []string{"r1", r2}, WithMode(ModeShared))
+	if err != nil {
+		t.Fatalf("first shared AcquireResources: %v", err)
+	}
+	defer first.Release()
+
+	// A second reader should not wait for the first.
+	second, err := b.AcquireResources(ctx, "u1", "a1", []string{r2, "r1"}, WithMode(ModeShared))
+	if err != nil {
+		t.Fatalf("second shared AcquireResources: %v", err)
+	}
+	defer second.Release()
+
+	// A writer of one of the resources must wait for both readers.
+	done := make(chan error, 1)
+	go func() {
+		h, err := b.Acquire(ctx, LevelResource, "u1", "a1", "r1")
+		if h != nil {
+			defer h.Release()
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("expected writer to block, but returned early: %v", err)
+	case <-time.After(150 * time.Millisecond):
+		// ok
+	}
+
+	_ = first.Release()
+	select {
+	case err := <-done:
+		t.Fatalf("expected writer to keep waiting for the second reader, got: %v", err)
+	case <-time.After(150 * time.Millisecond):
+		// ok
+	}
+
+	_ = second.Release()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("writer should succeed after readers release, got: %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("writer did not finish in time")
+	}
+}
+
+// TestHierarchy_AccountsBatchMatrix checks what an AcquireAccounts batch over
+// (a1, a2) blocks: everything under those accounts, nothing under siblings.
+func TestHierarchy_AccountsBatchMatrix(t *testing.T) {
+	forEachBackend(t, testAccountsBatchMatrix)
+}
+
+func testAccountsBatchMatrix(t *testing.T, b testBackend) {
+	u1, a1, a2, r1 := "u1", "a1", "", "r1"
+	a2 = pickDifferentAccountIDNonCollidingResource(u1, a1, r1)
+	a3 := a2 + "_sib"
+	for accountTarget(u1, a3) == accountTarget(u1, a1) || accountTarget(u1, a3) == accountTarget(u1, a2) {
+		a3 += "_"
+	}
+	u2 := pickDifferentUserIDNonColliding(u1, a1, r1)
+
+	cases := []struct {
+		name      string
+		mode      LockMode
+		second    acquireSpec
+		wantBlock bool
+	}{
+		{name: "X batch blocks resource under first account", second: acquireSpec{level: LevelResource, userID: u1, accountID: a1, resourceID: r1}, wantBlock: true},
+		{name: "X batch blocks resource under second account", second: acquireSpec{level: LevelResource, userID: u1, accountID: a2, resourceID: r1}, wantBlock: true},
+		{name: "X batch blocks shared read of a batched account", second: acquireSpec{level: LevelAccount, userID: u1, accountID: a2, mode: ModeShared}, wantBlock: true},
+		{name: "X batch allows resource under sibling account", second: acquireSpec{level: LevelResource, userID: u1, accountID: a3, resourceID: r1}, wantBlock: false},
+		{name: "X batch allows sibling account", second: acquireSpec{level: LevelAccount, userID: u1, accountID: a3}, wantBlock: false},
+		{name: "X batch allows shared user", second: acquireSpec{level: LevelUser, userID: u1, mode: ModeShared}, wantBlock: false},
+		{name: "X batch blocks exclusive user", second: acquireSpec{level: LevelUser, userID: u1}, wantBlock: true},
+		{name: "X batch allows other user", second: acquireSpec{level: LevelResource, userID: u2, accountID: a1, resourceID: r1}, wantBlock: false},
+		{name: "S batch allows shared resource", mode: ModeShared, second: acquireSpec{level: LevelResource, userID: u1, accountID: a1, resourceID: r1, mode: ModeShared}, wantBlock: false},
+		{name: "S batch blocks exclusive account", mode: ModeShared, second: acquireSpec{level: LevelAccount, userID: u1, accountID: a1}, wantBlock: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			b.reset(ctx, t)
+			for _, a := range []string{a1, a2} {
+				b.provision(ctx, t, mustTargets(LevelAccount, u1, a, "")...)
+			}
+			s := tc.second
+			b.provision(ctx, t, mustTargets(s.level, s.userID, s.accountID, s.resourceID)...)
+
+			// Reversed and duplicated input locks the same rows.
+			first, err := b.acquireAccounts(ctx, u1, []string{a2, a1, a2}, WithMode(tc.mode))
+			if err != nil {
+				t.Fatalf("AcquireAccounts: %v", err)
+			}
+			defer first.Release()
+
+			second, err := b.TryAcquire(ctx, s.level, s.userID, s.accountID, s.resourceID, WithMode(s.mode))
+			if err == nil {
+				_ = second.Release()
+			}
+			if blocked := errors.Is(err, ErrWouldBlock); blocked != tc.wantBlock {
+				t.Fatalf("blocked=%v, want %v (err=%v)", blocked, tc.wantBlock, err)
+			}
+			if err != nil && !errors.Is(err, ErrWouldBlock) {
+				t.Fatalf("second acquire: %v", err)
+			}
+		})
+	}
+}
+
+func TestAcquireAccounts_Validation(t *testing.T) {
+	// sql.Open does not connect, so these checks run without MySQL.
+	db, err := sql.Open("mysql", "invalid:invalid@tcp(127.0.0.1:1)/none")
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	defer db.Close()
+
+	repo := NewRepository(db)
+	ctx := context.Background()
+	for _, tc := range []struct {
+		userID   string
+		accounts []string
+	}{
+		{"", []string{"a1"}},
+		{"u1", nil},
+		{"u1", []string{"a1", ""}},
+	} {
+		if _, err := repo.GetAccountsLock(ctx, tc.userID, tc.accounts); !errors.Is(err, ErrInvalidArgument) {
+			t.Fatalf("GetAccountsLock(%q, %q): expected ErrInvalidArgument, got %v", tc.userID, tc.accounts, err)
+		}
+	}
+}
+
+func TestAcquire_UnknownMode(t *testing.T) {
+	if _, err := newAcquireConfig([]AcquireOption{WithMode(LockMode(42))}); err == nil {
+		t.Fatalf("expected error for unknown mode")
+	}
+}
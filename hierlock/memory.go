@@ -0,0 +1,194 @@
+package hierlock
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryLocker is a Locker that keeps its locks in process memory instead
+// of MySQL. It plans acquisitions exactly like Manager, with the same
+// hierarchy, bucket striping, (level, bucket) order and modes, and then
+// takes each bucket "row" from an in-memory lock table that behaves like
+// InnoDB's: shared holders coexist, a conflicting request waits, and a
+// request also waits behind an earlier conflicting waiter, so writers are
+// not starved by a stream of readers.
+//
+// It excludes only the goroutines of one process and needs no table
+// provisioning. Waits end with the context (a *LockError wrapping its
+// error) or the lock wait timeout options (ErrLockWaitTimeout); the Try
+// methods fail with ErrWouldBlock.
+//
+// ManagerOptions plan acquisitions as described at ManagerOption.
+// Escalation and bucket collisions behave as with Manager, but the handles
+// only support Release.
+type MemoryLocker struct {
+	stepLocker
+
+	mu      sync.Mutex
+	rows    map[lockTarget]*memoryRow
+	changed chan struct{} // closed and replaced whenever a row is released
+}
+
+type memoryRow struct {
+	held    map[*memoryHandle]lockStep
+	waiting []*memoryWaiter // in arrival order
+}
+
+type memoryWaiter struct {
+	h  *memoryHandle
+	st lockStep
+}
+
+type memoryHandle struct {
+	l        *MemoryLocker
+	steps    []lockStep
+	released bool // guarded by l.mu
+}
+
+var _ Locker = (*MemoryLocker)(nil)
+
+// NewMemoryLocker returns an empty in-memory lock table.
+func NewMemoryLocker(opts ...ManagerOption) *MemoryLocker {
+	l := &MemoryLocker{
+		rows:    map[lockTarget]*memoryRow{},
+		changed: make(chan struct{}),
+	}
+	l.stepLocker = stepLocker{plan: NewManager(nil, opts...), lock: l.lockSteps}
+	return l
+}
+
+// lockSteps takes steps in order. If one fails, the rows already taken are
+// released.
+func (l *MemoryLocker) lockSteps(ctx context.Context, steps []lockStep, cfg acquireConfig) (Handle, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	h := &memoryHandle{l: l}
+	for _, st := range steps {
+		if err := l.lockStep(ctx, h, st, cfg); err != nil {
+			_ = h.Release()
+			return nil, err
+		}
+		h.steps = append(h.steps, st)
+	}
+	return h, nil
+}
+
+func (l *MemoryLocker) lockStep(ctx context.Context, h *memoryHandle, st lockStep, cfg acquireConfig) error {
+	fail := func(cause error) error {
+		return &LockError{Target: st.name, Level: st.target.level, Bucket: st.target.bucket, Exclusive: st.bucketExclusive(), Cause: cause}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	r := l.rows[st.target]
+	if r == nil {
+		r = &memoryRow{held: map[*memoryHandle]lockStep{}}
+		l.rows[st.target] = r
+	}
+	if r.grantable(h, st, nil) {
+		r.held[h] = st
+		return nil
+	}
+	if cfg.wait == waitNoWait {
+		l.dropIfIdle(st.target)
+		return fail(ErrWouldBlock)
+	}
+
+	var timeout <-chan time.Time
+	if secs := cfg.lockWaitSeconds(ctx, st.target.level); secs > 0 {
+		timer := time.NewTimer(time.Duration(secs) * time.Second)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	w := &memoryWaiter{h: h, st: st}
+	r.waiting = append(r.waiting, w)
+	for !r.grantable(h, st, w) {
+		changed := l.changed
+		l.mu.Unlock()
+		var cause error
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			cause = ctx.Err()
+		case <-timeout:
+			cause = ErrLockWaitTimeout
+		}
+		l.mu.Lock()
+		if cause != nil {
+			r.removeWaiter(w)
+			l.dropIfIdle(st.target)
+			l.broadcast() // requests queued behind w may proceed
+			return fail(cause)
+		}
+	}
+	r.removeWaiter(w)
+	r.held[h] = st
+	return nil
+}
+
+// grantable reports whether h may take st now: no other holder conflicts
+// and, like InnoDB, no conflicting request of another handle is queued
+// ahead of w (ahead of everyone when w is nil). l.mu must be held.
+func (r *memoryRow) grantable(h *memoryHandle, st lockStep, w *memoryWaiter) bool {
+	for o, held := range r.held {
+		if o != h && st.conflicts(held) {
+			return false
+		}
+	}
+	for _, o := range r.waiting {
+		if o == w {
+			break
+		}
+		if o.h != h && st.conflicts(o.st) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *memoryRow) removeWaiter(w *memoryWaiter) {
+	for i, o := range r.waiting {
+		if o == w {
+			r.waiting = append(r.waiting[:i], r.waiting[i+1:]...)
+			return
+		}
+	}
+}
+
+// dropIfIdle forgets the row of target once nobody holds or waits for it.
+// l.mu must be held.
+func (l *MemoryLocker) dropIfIdle(target lockTarget) {
+	if r := l.rows[target]; r != nil && len(r.held) == 0 && len(r.waiting) == 0 {
+		delete(l.rows, target)
+	}
+}
+
+// broadcast wakes every waiter to re-check its row. l.mu must be held.
+func (l *MemoryLocker) broadcast() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// Release releases every row of the handle. Releasing twice is a no-op.
+func (h *memoryHandle) Release() error {
+	if h == nil {
+		return nil
+	}
+	l := h.l
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if h.released {
+		return nil
+	}
+	h.released = true
+	for _, st := range h.steps {
+		if r := l.rows[st.target]; r != nil {
+			delete(r.held, h)
+			l.dropIfIdle(st.target)
+		}
+	}
+	l.broadcast()
+	return nil
+}
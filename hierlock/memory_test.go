@@ -0,0 +1,178 @@
+package hierlock
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryLocker_TryAcquireAndRelease(t *testing.T) {
+	l := NewMemoryLocker()
+	ctx := context.Background()
+
+	h, err := l.Acquire(ctx, LevelResource, "u1", "a1", "r1")
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	_, err = l.TryAcquire(ctx, LevelAccount, "u1", "a1", "")
+	var le *LockError
+	if !errors.Is(err, ErrWouldBlock) || !errors.As(err, &le) || le.Target != "Account(u1/a1)" {
+		t.Fatalf("expected ErrWouldBlock on Account(u1/a1), got %v", err)
+	}
+	if err := h.Release(); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if err := h.Release(); err != nil {
+		t.Fatalf("second Release: %v", err)
+	}
+	if len(l.rows) != 0 {
+		t.Fatalf("rows left after release: %v", l.rows)
+	}
+
+	if _, err := l.Acquire(ctx, LevelResource, "u1", "", "r1"); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("expected ErrInvalidArgument, got %v", err)
+	}
+}
+
+func TestMemoryLocker_WaitEndsWithContextOrTimeout(t *testing.T) {
+	l := NewMemoryLocker()
+	holder, err := l.Acquire(context.Background(), LevelAccount, "u1", "a1", "")
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	defer holder.Release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := l.Acquire(ctx, LevelResource, "u1", "a1", "r1"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	start := time.Now()
+	_, err = l.Acquire(context.Background(), LevelAccount, "u1", "a1", "", WithLockWaitTimeout(time.Second))
+	if !errors.Is(err, ErrLockWaitTimeout) || time.Since(start) < time.Second {
+		t.Fatalf("expected ErrLockWaitTimeout after 1s, got %v after %v", err, time.Since(start))
+	}
+
+	// The abandoned waits left nothing behind: User(u1) is still only shared.
+	if h, err := l.TryAcquire(context.Background(), LevelUser, "u1", "", "", WithMode(ModeShared)); err != nil {
+		t.Fatalf("shared User after abandoned waits: %v", err)
+	} else {
+		_ = h.Release()
+	}
+}
+
+func TestMemoryLocker_QueuedWriterBlocksNewReaders(t *testing.T) {
+	l := NewMemoryLocker()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	reader, err := l.Acquire(ctx, LevelAccount, "u1", "a1", "", WithMode(ModeShared))
+	if err != nil {
+		t.Fatalf("reader: %v", err)
+	}
+	writer := make(chan error, 1)
+	go func() {
+		h, err := l.Acquire(ctx, LevelAccount, "u1", "a1", "")
+		if err == nil {
+			_ = h.Release()
+		}
+		writer <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// Like InnoDB, a new reader queues behind the waiting writer.
+	if _, err := l.TryAcquire(ctx, LevelAccount, "u1", "a1", "", WithMode(ModeShared)); !errors.Is(err, ErrWouldBlock) {
+		t.Fatalf("reader behind a queued writer: expected ErrWouldBlock, got %v", err)
+	}
+	_ = reader.Release()
+	if err := <-writer; err != nil {
+		t.Fatalf("writer: %v", err)
+	}
+}
+
+func TestMemoryLocker_BucketCollisionsBlock(t *testing.T) {
+	l := NewMemoryLocker()
+	x, y := findCollidingResourceIDs("u1", "a1")
+	h, err := l.Acquire(context.Background(), LevelResource, "u1", "a1", x)
+	if err != nil {
+		t.Fatalf("Acquire(%s): %v", x, err)
+	}
+	defer h.Release()
+	if _, err := l.TryAcquire(context.Background(), LevelResource, "u1", "a1", y); !errors.Is(err, ErrWouldBlock) {
+		t.Fatalf("%s shares the bucket of %s: expected ErrWouldBlock, got %v", y, x, err)
+	}
+}
+
+func TestMemoryLocker_OppositeSetsDoNotDeadlock(t *testing.T) {
+	l := NewMemoryLocker()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	set := []LockRequest{
+		{Level: LevelResource, UserID: "u1", AccountID: "a1", ResourceID: "r1"},
+		{Level: LevelAccount, UserID: "u2", AccountID: "a1"},
+		{Level: LevelResource, UserID: "u1", AccountID: "a2", ResourceID: "r9", Mode: ModeShared},
+	}
+	reversed := slices.Clone(set)
+	slices.Reverse(reversed)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for _, reqs := range [][]LockRequest{set, reversed, set, reversed} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				h, err := l.AcquireSet(ctx, reqs)
+				if err != nil {
+					errs <- err
+					return
+				}
+				_ = h.Release()
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("AcquireSet: %v", err)
+	}
+}
+
+func TestMemoryLocker_Escalation(t *testing.T) {
+	l := NewMemoryLocker(WithEscalation(2))
+	ctx := context.Background()
+	h, err := l.AcquireResources(ctx, "u1", "a1", []string{"r1", "r2", "r3"})
+	if err != nil {
+		t.Fatalf("AcquireResources: %v", err)
+	}
+	defer h.Release()
+	// The Account is exclusive, so even an unrelated resource waits.
+	if _, err := l.TryAcquire(ctx, LevelResource, "u1", "a1", "r99"); !errors.Is(err, ErrWouldBlock) {
+		t.Fatalf("expected the escalated Account to block, got %v", err)
+	}
+}
+
+func TestMemoryLocker_EscalationWithIntentionLocks(t *testing.T) {
+	l := NewMemoryLocker(WithIntentionLocks(4), WithEscalation(2))
+	ctx := context.Background()
+	h, err := l.AcquireResources(ctx, "u1", "a1", []string{"r1", "r2", "r3"}, WithMode(ModeShared))
+	if err != nil {
+		t.Fatalf("AcquireResources: %v", err)
+	}
+	defer h.Release()
+	// The escalated Account is exclusive, so the User is held IX, which
+	// excludes a reader of the whole User.
+	if _, err := l.TryAcquire(ctx, LevelUser, "u1", "", "", WithMode(ModeShared)); !errors.Is(err, ErrWouldBlock) {
+		t.Fatalf("expected the escalated Account to block a User reader, got %v", err)
+	}
+	other, err := l.TryAcquire(ctx, LevelAccount, "u1", pickDifferentAccountIDNonCollidingResource("u1", "a1", "r1"), "")
+	if err != nil {
+		t.Fatalf("a sibling Account must stay available: %v", err)
+	}
+	_ = other.Release()
+}
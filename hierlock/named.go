@@ -0,0 +1,298 @@
+package hierlock
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Named-lock backend (NamedLocker).
+//
+// MySQL's user-level locks (GET_LOCK / RELEASE_LOCK) need no table, but
+// they are exclusive only and belong to a session rather than a
+// transaction. Each row that Manager would lock, the bucket row of a
+// (level, bucket) and with WithIntentionLocks each of its intent rows, is
+// mapped to a lock name and emulated as a readers/writer lock with K+1
+// exclusive names:
+//
+//	gate:       hierlock/<level>/<bucket>[/i<slot>]
+//	reader k:   <gate>/r<k>, k = 0..K-1
+//
+//	FOR SHARE:  GET_LOCK(gate), GET_LOCK(one free reader k), RELEASE_LOCK(gate)
+//	FOR UPDATE: GET_LOCK(gate), GET_LOCK(reader 0) ... GET_LOCK(reader K-1)
+//
+// A shared holder keeps one reader name, an exclusive holder keeps all of
+// them and the gate. A writer waiting for readers to leave already holds the
+// gate, so later readers queue behind it like they do behind a waiting
+// FOR UPDATE in InnoDB. Names are always taken gate first and then in
+// reader order, after the rows in (level, bucket) order, so the emulation
+// adds no deadlock of its own.
+//
+// The differences from the bucket backend:
+//
+//   - At most K holders share a row. Reader k is picked round-robin per
+//     NamedLocker; when all K are taken the next reader waits (or fails with
+//     ErrWouldBlock), a false conflict like a bucket collision.
+//   - Locks belong to the handle's session, not to a transaction: they
+//     survive COMMIT and ROLLBACK on NamedLockHandle.Conn and are released
+//     by Release or when the session ends.
+//   - Lock names are server-wide, not per schema, and no rows need to be
+//     provisioned, so ErrBucketNotProvisioned never occurs.
+//   - Each row costs 2 (shared) or K+1 (exclusive) statements.
+//   - Readers hold the gate while they pick a reader name, so the Try
+//     methods retry a busy gate for up to namedGateTryWait before failing
+//     with ErrWouldBlock, and may take that long to report a writer.
+
+// defaultNamedLockReaders is the number of reader names per row.
+const defaultNamedLockReaders = 8
+
+// namedGateTryWait bounds how long the Try methods retry a busy gate.
+const namedGateTryWait = 50 * time.Millisecond
+
+// NamedLockerOption configures a NamedLocker. Every ManagerOption is a
+// NamedLockerOption that configures how acquisitions are planned (see
+// ManagerOption).
+type NamedLockerOption interface {
+	applyNamedLocker(*namedLockerConfig)
+}
+
+type namedLockerConfig struct {
+	plan    []ManagerOption
+	readers int
+}
+
+func (o ManagerOption) applyNamedLocker(c *namedLockerConfig) {
+	c.plan = append(c.plan, o)
+}
+
+type namedLockerOption func(*namedLockerConfig)
+
+func (o namedLockerOption) applyNamedLocker(c *namedLockerConfig) {
+	o(c)
+}
+
+// WithNamedLockReaders sets how many holders can share a row of a
+// NamedLocker (default 8, capped at 64).
+func WithNamedLockReaders(n int) NamedLockerOption {
+	return namedLockerOption(func(c *namedLockerConfig) {
+		c.readers = min(max(n, 1), 64)
+	})
+}
+
+// NamedLocker is a Locker that takes MySQL user-level locks (GET_LOCK)
+// instead of row locks. It plans acquisitions exactly like Manager and
+// emulates shared locks with reader names; see the comment above for the
+// mapping and how its semantics differ.
+//
+// Each handle holds its own connection of db until Release. Waits end
+// with the lock wait timeout options (ErrLockWaitTimeout), or else with
+// the context's deadline; the Try methods fail with ErrWouldBlock.
+type NamedLocker struct {
+	stepLocker
+	db      *sql.DB
+	readers int
+	seq     atomic.Uint32 // picks the first reader name to try
+}
+
+var _ Locker = (*NamedLocker)(nil)
+
+// NewNamedLocker returns a NamedLocker on db.
+func NewNamedLocker(db *sql.DB, opts ...NamedLockerOption) *NamedLocker {
+	cfg := namedLockerConfig{readers: defaultNamedLockReaders}
+	for _, opt := range opts {
+		if opt != nil {
+			opt.applyNamedLocker(&cfg)
+		}
+	}
+	l := &NamedLocker{db: db, readers: cfg.readers}
+	l.stepLocker = stepLocker{plan: NewManager(nil, cfg.plan...), lock: l.lockSteps}
+	return l
+}
+
+// NamedLockHandle holds the named locks of one acquisition on its own
+// session.
+type NamedLockHandle struct {
+	conn *sql.Conn
+	once sync.Once
+	err  error
+}
+
+// Conn returns the session holding the locks. Work run on it, including
+// transactions, runs while the locks are held; they stay held after the
+// transactions end. It must not be used after Release.
+func (h *NamedLockHandle) Conn() *sql.Conn {
+	return h.conn
+}
+
+// Release releases every lock of the handle and returns its session to the
+// pool. Releasing twice is a no-op.
+func (h *NamedLockHandle) Release() error {
+	if h == nil {
+		return nil
+	}
+	h.once.Do(func() {
+		h.err = releaseSession(h.conn)
+	})
+	return h.err
+}
+
+// releaseSession releases every named lock of conn and closes it. A session
+// whose locks could not be released is discarded instead of being returned
+// to the pool, which ends it and so releases them.
+func releaseSession(conn *sql.Conn) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := conn.ExecContext(ctx, "DO RELEASE_ALL_LOCKS()")
+	if err != nil {
+		_ = conn.Raw(func(any) error { return driver.ErrBadConn })
+	}
+	_ = conn.Close()
+	return err
+}
+
+// namedRow is a row of the bucket backend, emulated by named locks.
+type namedRow struct {
+	name      string // the gate; reader k is name + "/r<k>"
+	exclusive bool
+}
+
+// namedRows returns the rows st locks in the bucket backend, in order, as
+// lock names.
+func namedRows(st lockStep) []namedRow {
+	base := fmt.Sprintf("hierlock/%d/%d", int(st.target.level), st.target.bucket)
+	var rows []namedRow
+	for _, r := range st.rows() {
+		name := base
+		if r.slot >= 0 {
+			name = fmt.Sprintf("%s/i%d", base, r.slot)
+		}
+		rows = append(rows, namedRow{name: name, exclusive: r.exclusive})
+	}
+	return rows
+}
+
+// lockSteps takes the rows of steps in order on a new session. If one
+// fails, the session is released.
+func (l *NamedLocker) lockSteps(ctx context.Context, steps []lockStep, cfg acquireConfig) (Handle, error) {
+	if l.db == nil {
+		return nil, invalidArgf("named locker db is nil")
+	}
+	conn, err := l.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, st := range steps {
+		timeout := l.timeout(ctx, st, cfg)
+		for _, row := range namedRows(st) {
+			if err := l.lockRow(ctx, conn, st, row, timeout); err != nil {
+				_ = releaseSession(conn)
+				return nil, err
+			}
+		}
+	}
+	return &NamedLockHandle{conn: conn}, nil
+}
+
+// timeout returns the GET_LOCK timeout for the rows of st: 0 for the Try
+// methods, the lock wait timeout options if any, the time left until the
+// context's deadline, or -1 (no limit).
+func (l *NamedLocker) timeout(ctx context.Context, st lockStep, cfg acquireConfig) int {
+	if cfg.wait == waitNoWait {
+		return 0
+	}
+	if secs := cfg.lockWaitSeconds(ctx, st.target.level); secs > 0 {
+		return secs
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		return ceilSeconds(time.Until(deadline))
+	}
+	return -1
+}
+
+func (l *NamedLocker) lockRow(ctx context.Context, conn *sql.Conn, st lockStep, row namedRow, timeout int) error {
+	fail := func(cause error) error {
+		return &LockError{Target: st.name, Level: st.target.level, Bucket: st.target.bucket, Exclusive: row.exclusive, Cause: cause}
+	}
+	reader := func(k int) string {
+		return fmt.Sprintf("%s/r%d", row.name, k)
+	}
+
+	if err := getGate(ctx, conn, row.name, timeout); err != nil {
+		return fail(err)
+	}
+	if row.exclusive {
+		for k := range l.readers {
+			if err := getLock(ctx, conn, reader(k), timeout); err != nil {
+				return fail(err)
+			}
+		}
+		return nil
+	}
+
+	first := int(l.seq.Add(1)-1) % l.readers
+	got := false
+	for i := range l.readers {
+		err := getLock(ctx, conn, reader((first+i)%l.readers), 0)
+		if err == nil {
+			got = true
+			break
+		}
+		if err != ErrWouldBlock {
+			return fail(err)
+		}
+	}
+	if !got {
+		if err := getLock(ctx, conn, reader(first), timeout); err != nil {
+			return fail(err)
+		}
+	}
+	if _, err := conn.ExecContext(ctx, "DO RELEASE_LOCK(?)", row.name); err != nil {
+		return fail(err)
+	}
+	return nil
+}
+
+// getGate takes the gate of a row. Without a timeout it retries for up to
+// namedGateTryWait, since another reader may hold the gate only for the few
+// statements that pick its reader name; GET_LOCK cannot wait for less than
+// a second.
+func getGate(ctx context.Context, conn *sql.Conn, name string, timeout int) error {
+	if timeout != 0 {
+		return getLock(ctx, conn, name, timeout)
+	}
+	deadline := time.Now().Add(namedGateTryWait)
+	backoff := minProbeBackoff
+	for {
+		err := getLock(ctx, conn, name, 0)
+		if err != ErrWouldBlock || time.Now().After(deadline) {
+			return err
+		}
+		if !sleepContext(ctx, backoff) {
+			return ctx.Err()
+		}
+		backoff = min(2*backoff, maxProbeBackoff)
+	}
+}
+
+// getLock runs GET_LOCK(name, timeout). A timeout of 0 fails with
+// ErrWouldBlock instead of ErrLockWaitTimeout.
+func getLock(ctx context.Context, conn *sql.Conn, name string, timeout int) error {
+	var got sql.NullInt64
+	if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", name, timeout).Scan(&got); err != nil {
+		return err
+	}
+	switch {
+	case !got.Valid:
+		return fmt.Errorf("GET_LOCK(%q) returned NULL", name)
+	case got.Int64 == 1:
+		return nil
+	case timeout == 0:
+		return ErrWouldBlock
+	default:
+		return ErrLockWaitTimeout
+	}
+}
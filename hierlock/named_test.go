@@ -0,0 +1,152 @@
+package hierlock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestNamedRows_MirrorBucketAndIntentRows(t *testing.T) {
+	m := NewManager(nil, WithIntentionLocks(3))
+	path := Path{"u1", "a1"}
+	tgt := accountTarget("u1", "a1")
+	base := fmt.Sprintf("hierlock/%d/%d", int(tgt.level), tgt.bucket)
+
+	cases := []struct {
+		mode LockMode
+		want []namedRow
+	}{
+		{ModeIntentShared, []namedRow{{base, false}}},
+		{ModeIntentExclusive, []namedRow{{base, false}, {base + "/i1", true}}},
+		{ModeShared, []namedRow{{base, false}, {base + "/i0", false}, {base + "/i1", false}, {base + "/i2", false}}},
+		{ModeSharedIntentExclusive, []namedRow{{base, false}, {base + "/i0", false}, {base + "/i1", true}, {base + "/i2", false}}},
+		{ModeExclusive, []namedRow{{base, true}}},
+	}
+	for _, tc := range cases {
+		st := m.h.step(path, tc.mode, true)
+		st.slots, st.slot = m.intentSlots, 1
+		if got := namedRows(st); !slices.Equal(got, tc.want) {
+			t.Fatalf("%s: rows = %v, want %v", tc.mode, got, tc.want)
+		}
+	}
+
+	// Without intention locks only the bucket row is locked.
+	st := defaultHierarchy.step(path, ModeSharedIntentExclusive, true)
+	if got := namedRows(st); !slices.Equal(got, []namedRow{{base, true}}) {
+		t.Fatalf("SIX without slots: rows = %v", got)
+	}
+}
+
+// The matrix tests show where NamedLocker matches the bucket backend; the
+// tests below cover where it differs.
+
+func TestNewNamedLocker_Options(t *testing.T) {
+	if l := NewNamedLocker(nil); l.readers != defaultNamedLockReaders {
+		t.Fatalf("default readers = %d, want %d", l.readers, defaultNamedLockReaders)
+	}
+	l := NewNamedLocker(nil, WithIntentionLocks(3), WithNamedLockReaders(100), nil)
+	if l.readers != 64 {
+		t.Fatalf("readers = %d, want the cap of 64", l.readers)
+	}
+	if l.plan.intentSlots != 3 {
+		t.Fatalf("ManagerOptions must configure the plan: intentSlots = %d", l.plan.intentSlots)
+	}
+}
+
+func TestNamedLocker_ReaderCapacity(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	l := NewNamedLocker(db, WithNamedLockReaders(2))
+	for i := range 2 {
+		h, err := l.Acquire(ctx, LevelAccount, "u1", "a1", "", WithMode(ModeShared))
+		if err != nil {
+			t.Fatalf("shared holder %d: %v", i, err)
+		}
+		defer h.Release()
+	}
+	// InnoDB would grant a third FOR SHARE; here the reader names are used up.
+	if _, err := l.TryAcquire(ctx, LevelAccount, "u1", "a1", "", WithMode(ModeShared)); !errors.Is(err, ErrWouldBlock) {
+		t.Fatalf("third shared holder: expected ErrWouldBlock, got %v", err)
+	}
+	// Shared ancestors take reader names too.
+	if _, err := l.TryAcquire(ctx, LevelResource, "u1", "a1", "r1"); !errors.Is(err, ErrWouldBlock) {
+		t.Fatalf("resource under a full account: expected ErrWouldBlock, got %v", err)
+	}
+}
+
+func TestNamedLocker_TryWaitsOutReadersAtTheGate(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Another reader holds the gate only while it picks a reader name.
+	gate := namedRows(defaultHierarchy.step(Path{"u1", "a1"}, ModeShared, true))[0].name
+	other, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatalf("Conn: %v", err)
+	}
+	defer releaseSession(other)
+	if err := getLock(ctx, other, gate, 0); err != nil {
+		t.Fatalf("GET_LOCK: %v", err)
+	}
+	released := make(chan error, 1)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		_, err := other.ExecContext(ctx, "DO RELEASE_LOCK(?)", gate)
+		released <- err
+	}()
+
+	// InnoDB grants a concurrent FOR SHARE NOWAIT; so must TryAcquire.
+	h, err := NewNamedLocker(db).TryAcquire(ctx, LevelAccount, "u1", "a1", "", WithMode(ModeShared))
+	if err != nil {
+		t.Fatalf("TryAcquire next to a reader at the gate: %v", err)
+	}
+	_ = h.Release()
+	if err := <-released; err != nil {
+		t.Fatalf("RELEASE_LOCK: %v", err)
+	}
+}
+
+func TestNamedLocker_LocksOutliveTransactions(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	l := NewNamedLocker(db)
+	h, err := l.Acquire(ctx, LevelAccount, "u1", "a1", "")
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	defer h.Release()
+
+	conn := h.(*NamedLockHandle).Conn()
+	for range 2 {
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			t.Fatalf("BeginTx: %v", err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("Commit: %v", err)
+		}
+		if _, err := l.TryAcquire(ctx, LevelAccount, "u1", "a1", ""); !errors.Is(err, ErrWouldBlock) {
+			t.Fatalf("after COMMIT the account must still be held, got %v", err)
+		}
+	}
+
+	if err := h.Release(); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	h2, err := l.TryAcquire(ctx, LevelAccount, "u1", "a1", "")
+	if err != nil {
+		t.Fatalf("TryAcquire after Release: %v", err)
+	}
+	_ = h2.Release()
+}
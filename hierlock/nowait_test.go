@@ -0,0 +1,122 @@
+package hierlock
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTryAcquire_WouldBlockReportsBusyTarget(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	setupLockTable(ctx, t, db)
+	seedBuckets(ctx, t, db, mustTargets(LevelResource, "u1", "a1", "r1")...)
+
+	m := NewManager(db)
+
+	holder, err := m.Acquire(ctx, LevelAccount, "u1", "a1", "")
+	if err != nil {
+		t.Fatalf("acquire account: %v", err)
+	}
+	defer holder.Release()
+
+	start := time.Now()
+	h, err := m.TryAcquire(ctx, LevelResource, "u1", "a1", "r1")
+	if err == nil {
+		_ = h.Release()
+		t.Fatalf("expected ErrWouldBlock, got nil")
+	}
+	if !errors.Is(err, ErrWouldBlock) {
+		t.Fatalf("expected ErrWouldBlock, got: %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("TryAcquire should not wait, took %v", d)
+	}
+	var le *LockError
+	if !errors.As(err, &le) {
+		t.Fatalf("expected *LockError, got %T", err)
+	}
+	want := accountTarget("u1", "a1")
+	if le.Level != want.level || le.Bucket != want.bucket {
+		t.Fatalf("busy target = (%d,%d), want (%d,%d)", le.Level, le.Bucket, want.level, want.bucket)
+	}
+
+	_ = holder.Release()
+	h, err = m.TryAcquire(ctx, LevelResource, "u1", "a1", "r1")
+	if err != nil {
+		t.Fatalf("TryAcquire after release: %v", err)
+	}
+	_ = h.Release()
+}
+
+func TestTryAcquireResources_RollsBackOnWouldBlock(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	setupLockTable(ctx, t, db)
+	r2 := pickDifferentResourceID("u1", "a1", "r1")
+	seedBuckets(ctx, t, db,
+		userTarget("u1"),
+		accountTarget("u1", "a1"),
+		resourceTarget("u1", "a1", "r1"),
+		resourceTarget("u1", "a1", r2),
+	)
+
+	repo := NewRepository(db)
+
+	holder, err := repo.GetResourceLock(ctx, "u1", "a1", r2)
+	if err != nil {
+		t.Fatalf("GetResourceLock: %v", err)
+	}
+
+	_, err = repo.TryGetResourcesLock(ctx, "u1", "a1", []string{"r1", r2})
+	if !errors.Is(err, ErrWouldBlock) {
+		t.Fatalf("expected ErrWouldBlock, got: %v", err)
+	}
+	var le *LockError
+	if !errors.As(err, &le) || le.Bucket != resourceTarget("u1", "a1", r2).bucket {
+		t.Fatalf("expected busy resource bucket, got: %v", err)
+	}
+
+	// The failed attempt must not keep r1 (or its ancestors) locked.
+	_ = holder.Release()
+	h, err := repo.TryGetUserLock(ctx, "u1")
+	if err != nil {
+		t.Fatalf("TryGetUserLock after failed TryGetResourcesLock: %v", err)
+	}
+	_ = h.Release()
+}
+
+func TestTryAcquire_SharedDoesNotBlockShared(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	setupLockTable(ctx, t, db)
+	seedBuckets(ctx, t, db, mustTargets(LevelAccount, "u1", "a1", "")...)
+
+	m := NewManager(db)
+
+	h1, err := m.TryAcquire(ctx, LevelAccount, "u1", "a1", "", WithMode(ModeShared))
+	if err != nil {
+		t.Fatalf("first shared TryAcquire: %v", err)
+	}
+	defer h1.Release()
+
+	h2, err := m.TryAcquire(ctx, LevelAccount, "u1", "a1", "", WithMode(ModeShared))
+	if err != nil {
+		t.Fatalf("second shared TryAcquire: %v", err)
+	}
+	defer h2.Release()
+
+	if _, err := m.TryAcquire(ctx, LevelAccount, "u1", "a1", ""); !errors.Is(err, ErrWouldBlock) {
+		t.Fatalf("expected exclusive TryAcquire to report ErrWouldBlock, got: %v", err)
+	}
+}
@@ -0,0 +1,149 @@
+package hierlock
+
+import (
+	"context"
+	"time"
+)
+
+// AcquireOption customizes a single acquisition.
+type AcquireOption func(*acquireConfig)
+
+type acquireConfig struct {
+	mode LockMode
+	wait waitPolicy
+
+	// innodb_lock_wait_timeout handling; see lockWaitSeconds.
+	lockWait            time.Duration
+	levelLockWait       map[Level]time.Duration
+	lockWaitFromContext bool
+
+	restartOnOrderViolation bool
+
+	// escalationThreshold overrides the manager's threshold when escalationSet.
+	escalationSet       bool
+	escalationThreshold int
+
+	// txn is the acquisition's transaction under deadlock prevention.
+	txn *txn
+}
+
+// waitPolicy controls what a lock statement does when the row is already locked.
+type waitPolicy int
+
+const (
+	waitBlock  waitPolicy = iota // wait for the holder (default)
+	waitNoWait                   // fail immediately with ErrWouldBlock
+)
+
+// WithMode sets the mode used for the target level (default ModeExclusive).
+func WithMode(mode LockMode) AcquireOption {
+	return func(c *acquireConfig) {
+		c.mode = mode
+	}
+}
+
+// WithLockWaitTimeout bounds the server-side wait of every lock statement by
+// setting innodb_lock_wait_timeout on the lock transaction's session.
+// The value is rounded up to whole seconds (minimum 1s).
+func WithLockWaitTimeout(d time.Duration) AcquireOption {
+	return func(c *acquireConfig) {
+		c.lockWait = d
+	}
+}
+
+// WithLevelLockWaitTimeout is like WithLockWaitTimeout, but only applies to
+// lock statements on the given level. It takes precedence over
+// WithLockWaitTimeout and WithContextLockWaitTimeout for that level; d == 0
+// keeps the server default there instead.
+func WithLevelLockWaitTimeout(level Level, d time.Duration) AcquireOption {
+	return func(c *acquireConfig) {
+		if c.levelLockWait == nil {
+			c.levelLockWait = map[Level]time.Duration{}
+		}
+		c.levelLockWait[level] = d
+	}
+}
+
+// WithContextLockWaitTimeout derives innodb_lock_wait_timeout from the time
+// left until the context deadline, re-evaluated before every lock statement,
+// so the server stops waiting when the client gives up. The value is rounded
+// down to whole seconds (minimum 1s). It has no effect without a deadline.
+func WithContextLockWaitTimeout() AcquireOption {
+	return func(c *acquireConfig) {
+		c.lockWaitFromContext = true
+	}
+}
+
+// WithRestartOnOrderViolation makes LockHandle.AddResources start over
+// instead of failing with ErrLockOrderViolation: the handle's transaction is
+// released and all resources, old and new, are acquired again in order in a
+// new transaction.
+func WithRestartOnOrderViolation() AcquireOption {
+	return func(c *acquireConfig) {
+		c.restartOnOrderViolation = true
+	}
+}
+
+// WithEscalationThreshold overrides the manager's escalation threshold for
+// one AcquireResources call: with more than n distinct resources, the
+// Account is locked exclusively instead. n <= 0 disables escalation for the
+// call.
+func WithEscalationThreshold(n int) AcquireOption {
+	return func(c *acquireConfig) {
+		c.escalationSet = true
+		c.escalationThreshold = n
+	}
+}
+
+func newAcquireConfig(opts []AcquireOption) (acquireConfig, error) {
+	var cfg acquireConfig
+	for _, opt := range opts {
+		if opt != nil {
+			opt(&cfg)
+		}
+	}
+	if !cfg.mode.valid() {
+		return cfg, invalidArgf("unknown lock mode: %v", cfg.mode)
+	}
+	if cfg.lockWait < 0 {
+		return cfg, invalidArgf("lock wait timeout must not be negative")
+	}
+	for _, d := range cfg.levelLockWait {
+		if d < 0 {
+			return cfg, invalidArgf("lock wait timeout must not be negative")
+		}
+	}
+	return cfg, nil
+}
+
+// lockWaitSeconds returns the innodb_lock_wait_timeout to use for a lock
+// statement on level, or 0 to keep the server default.
+func (c acquireConfig) lockWaitSeconds(ctx context.Context, level Level) int {
+	if d, ok := c.levelLockWait[level]; ok {
+		if d == 0 {
+			return 0
+		}
+		return ceilSeconds(d)
+	}
+	if c.lockWait > 0 {
+		return ceilSeconds(c.lockWait)
+	}
+	if c.lockWaitFromContext {
+		if deadline, ok := ctx.Deadline(); ok {
+			secs := int(time.Until(deadline) / time.Second)
+			if secs < 1 {
+				secs = 1
+			}
+			return secs
+		}
+	}
+	return 0
+}
+
+func ceilSeconds(d time.Duration) int {
+	secs := int((d + time.Second - 1) / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	return secs
+}
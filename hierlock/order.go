@@ -0,0 +1,70 @@
+package hierlock
+
+import (
+	"slices"
+)
+
+// Lock order.
+//
+// Every multi-target acquisition locks its rows in ascending (level, bucket)
+// order. Level IDs grow with depth, so ancestors still come before their
+// descendants, and two transactions that both follow the order never wait
+// for each other in a cycle, whatever IDs they started from. Ordering by ID
+// instead is not enough: the rows are buckets, and two IDs may share one.
+
+// less reports whether t is locked before u.
+func (t lockTarget) less(u lockTarget) bool {
+	if t.level != u.level {
+		return t.level < u.level
+	}
+	return t.bucket < u.bucket
+}
+
+// planSteps sorts steps into lock order and merges steps on the same row
+// into one step holding the strongest of their modes (see supremum). Rows
+// that several distinct nodes mapped to are reported as collisions, in lock
+// order.
+func planSteps(steps []lockStep) ([]lockStep, []BucketCollision) {
+	sorted := slices.Clone(steps)
+	slices.SortStableFunc(sorted, func(a, b lockStep) int {
+		switch {
+		case a.target.less(b.target):
+			return -1
+		case b.target.less(a.target):
+			return 1
+		default:
+			return 0
+		}
+	})
+
+	planned := sorted[:0]
+	var collisions []BucketCollision
+	var group []lockStep // distinct nodes on the current row
+	flush := func() {
+		if len(group) < 2 {
+			return
+		}
+		c := BucketCollision{Level: group[0].target.level, Bucket: group[0].target.bucket}
+		for _, st := range group {
+			c.IDs = append(c.IDs, st.id())
+			c.Targets = append(c.Targets, st.name)
+		}
+		collisions = append(collisions, c)
+	}
+	for _, st := range sorted {
+		if n := len(planned); n > 0 && planned[n-1].target == st.target {
+			prev := &planned[n-1]
+			prev.mode = supremum(prev.mode, st.mode)
+			prev.requested = prev.requested || st.requested
+			if !slices.ContainsFunc(group, func(g lockStep) bool { return g.name == st.name }) {
+				group = append(group, st)
+			}
+			continue
+		}
+		flush()
+		planned = append(planned, st)
+		group = []lockStep{st}
+	}
+	flush()
+	return planned, collisions
+}
@@ -0,0 +1,136 @@
+package hierlock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSupremum(t *testing.T) {
+	cases := []struct {
+		a, b, want LockMode
+	}{
+		{ModeIntentShared, ModeIntentShared, ModeIntentShared},
+		{ModeIntentShared, ModeIntentExclusive, ModeIntentExclusive},
+		{ModeIntentShared, ModeShared, ModeShared},
+		{ModeIntentExclusive, ModeShared, ModeSharedIntentExclusive},
+		{ModeIntentExclusive, ModeSharedIntentExclusive, ModeSharedIntentExclusive},
+		{ModeShared, ModeSharedIntentExclusive, ModeSharedIntentExclusive},
+		{ModeShared, ModeExclusive, ModeExclusive},
+		{ModeIntentShared, ModeExclusive, ModeExclusive},
+	}
+	for _, tc := range cases {
+		if got := supremum(tc.a, tc.b); got != tc.want {
+			t.Fatalf("supremum(%v, %v) = %v, want %v", tc.a, tc.b, got, tc.want)
+		}
+		if got := supremum(tc.b, tc.a); got != tc.want {
+			t.Fatalf("supremum(%v, %v) = %v, want %v", tc.b, tc.a, got, tc.want)
+		}
+	}
+}
+
+func TestPlanSteps_OrdersByLevelAndBucketAndMerges(t *testing.T) {
+	h := DefaultHierarchy()
+	x, y := findCollidingResourceIDs("u1", "a1")
+	var ids []string
+	for i := 0; i < 5; i++ {
+		ids = append(ids, fmt.Sprintf("r%d", i))
+	}
+
+	var steps []lockStep
+	for _, id := range append(ids, x) {
+		steps = append(steps, h.step(Path{"u1", "a1", id}, ModeShared, true))
+	}
+	steps = append(steps, h.step(Path{"u1", "a1", y}, ModeExclusive, true))
+	steps = append(steps, h.step(Path{"u1", "a1"}, ModeShared, false), h.step(Path{"u1"}, ModeShared, false))
+
+	planned, collisions := planSteps(steps)
+	if len(planned) != len(ids)+3 {
+		t.Fatalf("got %d steps, want %d", len(planned), len(ids)+3)
+	}
+	if !slices.IsSortedFunc(planned, func(a, b lockStep) int {
+		if a.target.less(b.target) {
+			return -1
+		}
+		return 1
+	}) {
+		t.Fatalf("steps not in (level, bucket) order: %+v", planned)
+	}
+	if planned[0].target != userTarget("u1") || planned[1].target != accountTarget("u1", "a1") {
+		t.Fatalf("ancestors must come first: %+v", planned[:2])
+	}
+
+	i := slices.IndexFunc(planned, func(st lockStep) bool { return st.target == resourceTarget("u1", "a1", x) })
+	if i < 0 || planned[i].mode != ModeExclusive {
+		t.Fatalf("merged step must hold the strongest mode, got %+v", planned[i])
+	}
+	if len(collisions) != 1 {
+		t.Fatalf("collisions %+v, want one group", collisions)
+	}
+	c := collisions[0]
+	if !slices.Equal(c.IDs, []string{x, y}) || c.Targets[0] != "Resource(u1/a1/"+x+")" {
+		t.Fatalf("collision = %+v", c)
+	}
+}
+
+func TestAcquireResources_ReportsBucketCollisions(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	setupLockTable(ctx, t, db)
+
+	x, y := findCollidingResourceIDs("u1", "a1")
+	seedBuckets(ctx, t, db, mustTargets(LevelResource, "u1", "a1", x)...)
+
+	m := NewManager(db)
+	h, err := m.AcquireResources(ctx, "u1", "a1", []string{y, x})
+	if err != nil {
+		t.Fatalf("AcquireResources: %v", err)
+	}
+	defer h.Release()
+
+	if got := len(h.Held()); got != 3 {
+		t.Fatalf("held %d rows, want 3 (User, Account, one Resource): %+v", got, h.Held())
+	}
+	cs := h.Collisions()
+	if len(cs) != 1 || cs[0].Bucket != resourceTarget("u1", "a1", x).bucket || len(cs[0].IDs) != 2 {
+		t.Fatalf("collisions = %+v", cs)
+	}
+}
+
+func TestLockHandle_AddResourcesFollowsBucketOrder(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	setupLockTable(ctx, t, db)
+
+	// Find IDs whose ID order is the opposite of their bucket order.
+	lo, hi := "b", "a"
+	for i := 0; resourceTarget("u1", "a1", lo).bucket > resourceTarget("u1", "a1", hi).bucket; i++ {
+		lo, hi = fmt.Sprintf("b%d", i), fmt.Sprintf("a%d", i)
+	}
+	seedBuckets(ctx, t, db, mustTargets(LevelResource, "u1", "a1", lo)...)
+	seedBuckets(ctx, t, db, resourceTarget("u1", "a1", hi))
+
+	m := NewManager(db)
+	h, err := m.AcquireResources(ctx, "u1", "a1", []string{lo})
+	if err != nil {
+		t.Fatalf("AcquireResources: %v", err)
+	}
+	defer h.Release()
+
+	// hi sorts before lo as an ID but its bucket comes later, so it is in order.
+	if err := h.AddResources(ctx, hi); err != nil {
+		t.Fatalf("AddResources(%s): %v", hi, err)
+	}
+	if _, err := m.TryAcquire(ctx, LevelResource, "u1", "a1", hi); !errors.Is(err, ErrWouldBlock) {
+		t.Fatalf("expected %s locked, got %v", hi, err)
+	}
+}
@@ -0,0 +1,380 @@
+package hierlock
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// PostgreSQL backend (PostgresLocker).
+//
+// The locker plans acquisitions exactly like Manager and takes each row
+// Manager would lock, the bucket row of a (level, bucket) and with
+// WithIntentionLocks each of its intent rows, in one transaction, so the
+// locks are released by COMMIT or ROLLBACK. PostgresMode selects how a row
+// is locked:
+//
+//	PostgresAdvisory:   pg_advisory_xact_lock_shared(key) / pg_advisory_xact_lock(key)
+//	PostgresBucketRows: SELECT ... FROM hier_lock_buckets ... FOR SHARE / FOR UPDATE
+//
+// Advisory keys are 64-bit: 0x686c ("hl") in the top 16 bits, then
+// level+1 (8 bits), the bucket (32 bits) and slot+1 (8 bits, 0 for the
+// bucket row), so keys of different rows never collide and stay clear of
+// small application keys. Advisory locks need no table; the bucket row mode
+// needs hier_lock_buckets (and hier_lock_intents) provisioned like MySQL.
+//
+// Advisory locks go through PostgreSQL's lock manager, which queues a
+// request behind conflicting waiters as InnoDB does. Row locks differ: a
+// FOR SHARE is granted next to other share holders even while a FOR UPDATE
+// waits, so a stream of readers can starve a writer. Two-party conflicts
+// are the same in both modes, so the matrix tests hold. The Try methods use
+// pg_try_advisory_xact_lock* or NOWAIT, the lock wait timeout options set
+// lock_timeout, and ClaimResources skips busy buckets with SKIP LOCKED (or
+// the try functions).
+
+// PostgresMode selects how a PostgresLocker locks rows.
+type PostgresMode int
+
+const (
+	// PostgresAdvisory takes transaction-level advisory locks.
+	PostgresAdvisory PostgresMode = iota
+	// PostgresBucketRows locks rows of hier_lock_buckets and
+	// hier_lock_intents.
+	PostgresBucketRows
+)
+
+// SQLSTATE codes that PostgresLocker classifies.
+const (
+	pgLockNotAvailable = "55P03" // NOWAIT or lock_timeout
+	pgDeadlockDetected = "40P01"
+)
+
+// pgAdvisoryKeySpace marks hierlock's advisory keys (top 16 bits).
+const pgAdvisoryKeySpace = 0x686c
+
+// PostgresLocker is a Locker on a PostgreSQL database. db may use any
+// driver whose errors report their SQLSTATE through a SQLState() string
+// method (lib/pq, pgx's stdlib). ManagerOptions plan acquisitions as
+// described at ManagerOption.
+type PostgresLocker struct {
+	stepLocker
+	db   *sql.DB
+	mode PostgresMode
+}
+
+var _ Locker = (*PostgresLocker)(nil)
+
+// NewPostgresLocker returns a PostgresLocker on db using mode.
+func NewPostgresLocker(db *sql.DB, mode PostgresMode, opts ...ManagerOption) *PostgresLocker {
+	l := &PostgresLocker{db: db, mode: mode}
+	l.stepLocker = stepLocker{plan: NewManager(nil, opts...), lock: l.lockSteps}
+	return l
+}
+
+// PostgresLockHandle holds the locks of one acquisition in its transaction.
+type PostgresLockHandle struct {
+	tx *sql.Tx
+}
+
+// Tx returns the transaction holding the locks. Work run on it is atomic
+// with the locks; committing or rolling it back releases them.
+func (h *PostgresLockHandle) Tx() *sql.Tx {
+	return h.tx
+}
+
+// Release rolls back the transaction. Releasing twice, or after the
+// transaction ended, is a no-op.
+func (h *PostgresLockHandle) Release() error {
+	if h == nil || h.tx == nil {
+		return nil
+	}
+	if err := h.tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+		return err
+	}
+	return nil
+}
+
+// pgSession runs the lock statements of one transaction.
+type pgSession struct {
+	l       *PostgresLocker
+	tx      *sql.Tx
+	timeout int // lock_timeout in seconds currently set; 0 for the default
+}
+
+func (l *PostgresLocker) begin(ctx context.Context) (*pgSession, error) {
+	if l.db == nil {
+		return nil, invalidArgf("postgres locker db is nil")
+	}
+	tx, err := l.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelReadCommitted})
+	if err != nil {
+		return nil, err
+	}
+	return &pgSession{l: l, tx: tx}, nil
+}
+
+// lockSteps takes the rows of steps in order in a new transaction. If one
+// fails, the transaction is rolled back.
+func (l *PostgresLocker) lockSteps(ctx context.Context, steps []lockStep, cfg acquireConfig) (Handle, error) {
+	s, err := l.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.lockSteps(ctx, steps, cfg); err != nil {
+		_ = s.tx.Rollback()
+		return nil, err
+	}
+	return &PostgresLockHandle{tx: s.tx}, nil
+}
+
+func (s *pgSession) lockSteps(ctx context.Context, steps []lockStep, cfg acquireConfig) error {
+	for _, st := range steps {
+		if cfg.wait == waitBlock {
+			if err := s.setTimeout(ctx, cfg.lockWaitSeconds(ctx, st.target.level)); err != nil {
+				return err
+			}
+		}
+		for _, r := range st.rows() {
+			if err := s.lockRow(ctx, st, r, cfg.wait); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// setTimeout sets lock_timeout for the rest of the transaction when secs
+// differs from the current value; 0 restores the session's value.
+func (s *pgSession) setTimeout(ctx context.Context, secs int) error {
+	if secs == s.timeout {
+		return nil
+	}
+	stmt := "SET LOCAL lock_timeout TO DEFAULT"
+	if secs > 0 {
+		stmt = fmt.Sprintf("SET LOCAL lock_timeout = '%ds'", secs)
+	}
+	if _, err := s.tx.ExecContext(ctx, stmt); err != nil {
+		return fmt.Errorf("set lock_timeout: %w", err)
+	}
+	s.timeout = secs
+	return nil
+}
+
+func (s *pgSession) lockRow(ctx context.Context, st lockStep, r stepRow, wait waitPolicy) error {
+	fail := func(cause error) error {
+		return &LockError{Target: st.name, Level: st.target.level, Bucket: st.target.bucket, Exclusive: r.exclusive, Cause: pgCause(cause, wait)}
+	}
+
+	if s.l.mode == PostgresAdvisory {
+		fn := "pg_advisory_xact_lock"
+		if wait == waitNoWait {
+			fn = "pg_try_advisory_xact_lock"
+		}
+		if !r.exclusive {
+			fn += "_shared"
+		}
+		if wait == waitNoWait {
+			var ok bool
+			if err := s.tx.QueryRowContext(ctx, "SELECT "+fn+"($1)", advisoryKey(st.target, r.slot)).Scan(&ok); err != nil {
+				return fail(err)
+			}
+			if !ok {
+				return fail(ErrWouldBlock)
+			}
+			return nil
+		}
+		if _, err := s.tx.ExecContext(ctx, "SELECT "+fn+"($1)", advisoryKey(st.target, r.slot)); err != nil {
+			return fail(err)
+		}
+		return nil
+	}
+
+	query := "SELECT bucket FROM hier_lock_buckets WHERE level = $1 AND bucket = $2"
+	args := []any{int(st.target.level), st.target.bucket}
+	if r.slot >= 0 {
+		query = "SELECT bucket FROM hier_lock_intents WHERE level = $1 AND bucket = $2 AND slot = $3"
+		args = append(args, r.slot)
+	}
+	if r.exclusive {
+		query += " FOR UPDATE"
+	} else {
+		query += " FOR SHARE"
+	}
+	if wait == waitNoWait {
+		query += " NOWAIT"
+	}
+	var got int
+	if err := s.tx.QueryRowContext(ctx, query, args...).Scan(&got); err != nil {
+		return fail(err)
+	}
+	return nil
+}
+
+// advisoryKey returns the advisory lock key of target's bucket row
+// (slot < 0) or of one of its intent rows.
+func advisoryKey(target lockTarget, slot int) int64 {
+	return pgAdvisoryKeySpace<<48 |
+		int64(target.level+1)<<40 |
+		int64(target.bucket)<<8 |
+		int64(slot+1)
+}
+
+// pgCause classifies a PostgreSQL error by its SQLSTATE, wrapping the
+// matching sentinel error around it.
+func pgCause(err error, wait waitPolicy) error {
+	var se interface{ SQLState() string }
+	if !errors.As(err, &se) {
+		return err
+	}
+	switch se.SQLState() {
+	case pgLockNotAvailable:
+		if wait == waitNoWait {
+			return fmt.Errorf("%w: %w", ErrWouldBlock, err)
+		}
+		return fmt.Errorf("%w: %w", ErrLockWaitTimeout, err)
+	case pgDeadlockDetected:
+		return fmt.Errorf("%w: %w", ErrDeadlock, err)
+	default:
+		return err
+	}
+}
+
+// PostgresClaim is the result of PostgresLocker.ClaimResources; see Claim.
+type PostgresClaim struct {
+	// Handle holds the ancestor locks and the claimed Resource buckets. It is
+	// nil when nothing could be claimed.
+	Handle *PostgresLockHandle
+	// Claimed lists the claimed candidate IDs in bucket order.
+	Claimed []string
+	// Collisions lists candidates that share a Resource bucket.
+	Collisions []BucketCollision
+}
+
+// Release releases the claim. It is safe to call on an empty claim.
+func (c *PostgresClaim) Release() error {
+	if c == nil {
+		return nil
+	}
+	return c.Handle.Release()
+}
+
+// ClaimResources claims up to limit resources under (userID, accountID) that
+// no other transaction currently holds, like Manager.ClaimResources: the
+// ancestors are locked shared (waiting), and busy Resource buckets are
+// skipped with FOR UPDATE SKIP LOCKED, or pg_try_advisory_xact_lock in the
+// advisory mode, lowest bucket first.
+func (l *PostgresLocker) ClaimResources(ctx context.Context, userID, accountID string, candidates []string, limit int) (*PostgresClaim, error) {
+	if userID == "" || accountID == "" {
+		return nil, invalidArgf("userID and accountID are required")
+	}
+	if len(candidates) == 0 {
+		return nil, invalidArgf("candidates is required")
+	}
+	if limit <= 0 {
+		return nil, invalidArgf("limit must be positive")
+	}
+	if slices.Contains(candidates, "") {
+		return nil, invalidArgf("resourceID is required")
+	}
+
+	m := l.plan
+	parent := Path{userID, accountID}
+	if err := m.h.validateParent(parent); err != nil {
+		return nil, err
+	}
+	byBucket, collisions := m.h.childCandidates(parent, candidates)
+	claim := &PostgresClaim{Collisions: collisions}
+	ancestors, err := m.parentSteps(parent, ModeExclusive)
+	if err != nil {
+		return nil, err
+	}
+	m.assignSlots(ancestors, m.nextSlot())
+
+	s, err := l.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rollback := func(cause error) (*PostgresClaim, error) {
+		_ = s.tx.Rollback()
+		return nil, cause
+	}
+	if err := s.lockSteps(ctx, ancestors, acquireConfig{}); err != nil {
+		return rollback(err)
+	}
+	buckets, err := s.claimBuckets(ctx, m.h, parent, byBucket, limit)
+	if err != nil {
+		return rollback(err)
+	}
+	if len(buckets) == 0 {
+		_ = s.tx.Rollback()
+		return claim, nil
+	}
+	for _, b := range buckets {
+		claim.Claimed = append(claim.Claimed, byBucket[b])
+	}
+	claim.Handle = &PostgresLockHandle{tx: s.tx}
+	return claim, nil
+}
+
+// claimBuckets claims up to limit of the buckets in byBucket, children of
+// parent in h. In the advisory mode each bucket is tried on its own, and a
+// failure is reported for that bucket; the SKIP LOCKED query fails as a
+// whole and is reported for parent (see claimError).
+func (s *pgSession) claimBuckets(ctx context.Context, h *Hierarchy, parent Path, byBucket map[int]string, limit int) ([]int, error) {
+	level := h.levels[len(parent)].ID
+	buckets := make([]int, 0, len(byBucket))
+	for b := range byBucket {
+		buckets = append(buckets, b)
+	}
+	sort.Ints(buckets)
+
+	if s.l.mode == PostgresAdvisory {
+		var claimed []int
+		for _, b := range buckets {
+			if len(claimed) == limit {
+				break
+			}
+			var ok bool
+			if err := s.tx.QueryRowContext(ctx, "SELECT pg_try_advisory_xact_lock($1)", advisoryKey(lockTarget{level: level, bucket: b}, -1)).Scan(&ok); err != nil {
+				return nil, &LockError{Target: h.name(parent.child(byBucket[b])), Level: level, Bucket: b, Exclusive: true, Cause: pgCause(err, waitBlock)}
+			}
+			if ok {
+				claimed = append(claimed, b)
+			}
+		}
+		return claimed, nil
+	}
+
+	args := make([]any, 0, len(buckets)+2)
+	args = append(args, int(level))
+	marks := make([]string, 0, len(buckets))
+	for _, b := range buckets {
+		args = append(args, b)
+		marks = append(marks, fmt.Sprintf("$%d", len(args)))
+	}
+	args = append(args, limit)
+	query := "SELECT bucket FROM hier_lock_buckets WHERE level = $1 AND bucket IN (" +
+		strings.Join(marks, ",") +
+		fmt.Sprintf(") ORDER BY bucket LIMIT $%d FOR UPDATE SKIP LOCKED", len(args))
+
+	rows, err := s.tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, h.claimError(parent, pgCause(err, waitBlock))
+	}
+	defer rows.Close()
+	var claimed []int
+	for rows.Next() {
+		var b int
+		if err := rows.Scan(&b); err != nil {
+			return nil, h.claimError(parent, pgCause(err, waitBlock))
+		}
+		claimed = append(claimed, b)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, h.claimError(parent, pgCause(err, waitBlock))
+	}
+	return claimed, nil
+}
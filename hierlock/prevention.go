@@ -0,0 +1,273 @@
+package hierlock
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Deadlock prevention (WithDeadlockPrevention).
+//
+// Ordered acquisition needs the whole lock set up front. Callers that
+// discover it as they go (AddResources out of order, Upgrade) can instead
+// let the manager prevent deadlocks with timestamps: every acquisition gets
+// a timestamp from a per-Manager counter, smaller meaning older, and keeps it
+// across its restarts, so it eventually becomes the oldest and wins. A
+// handle that Downgrade reacquires in a new transaction keeps its timestamp
+// too. (AddResources never restarts under deadlock prevention.)
+//
+// Rows are locked with NOWAIT probes. When a probe fails, the manager looks
+// up the transactions of the same Manager holding the row in a conflicting
+// mode and applies the policy:
+//
+//	WaitDie:   an older requester waits; a younger one dies (ErrDied).
+//	WoundWait: an older requester wounds younger holders and waits; a
+//	           younger requester waits.
+//
+// Waiting means probing again after a short backoff, so a transaction never
+// sleeps inside InnoDB and InnoDB's deadlock detector (1213) is never
+// involved. Waits only go from older to younger (WaitDie) or from younger to
+// older (WoundWait), so they cannot form a cycle.
+//
+// A wounded transaction aborts at its next probe. If it already returned its
+// LockHandle it keeps its locks until released: Wounded reports the request,
+// and its next Upgrade or AddResources fails with ErrWounded.
+//
+// Only acquisitions of the same Manager see each other. Holders outside it
+// (other processes, AcquireInTx, ClaimResources) are waited for by probing
+// until the lock wait timeout (WithLockWaitTimeout and friends) or the
+// context ends.
+
+// DeadlockPrevention selects the rule WithDeadlockPrevention applies.
+type DeadlockPrevention int
+
+const (
+	// WaitDie makes a younger requester abort and retry, and an older one
+	// wait.
+	WaitDie DeadlockPrevention = iota + 1
+	// WoundWait makes an older requester ask younger holders to abort, and a
+	// younger one wait.
+	WoundWait
+)
+
+func (p DeadlockPrevention) String() string {
+	switch p {
+	case WaitDie:
+		return "WaitDie"
+	case WoundWait:
+		return "WoundWait"
+	default:
+		return fmt.Sprintf("DeadlockPrevention(%d)", int(p))
+	}
+}
+
+// Probe and restart delays. Restarts reuse RetryPolicy's backoff.
+const (
+	minProbeBackoff = time.Millisecond
+	maxProbeBackoff = 50 * time.Millisecond
+)
+
+var restartBackoff = RetryPolicy{InitialBackoff: 2 * time.Millisecond, MaxBackoff: 100 * time.Millisecond, Jitter: 0.5}
+
+// txnRegistry records which transaction of a Manager holds which row.
+type txnRegistry struct {
+	policy DeadlockPrevention // 0: track only, for deadlock detection
+	seq    atomic.Uint64
+
+	mu    sync.Mutex
+	holds map[lockTarget][]txnHold
+}
+
+type txnHold struct {
+	txn  *txn
+	step lockStep
+}
+
+// txn is one acquisition under deadlock prevention, across its restarts.
+type txn struct {
+	reg     *txnRegistry
+	ts      uint64 // smaller is older
+	wounded atomic.Bool
+
+	// Guarded by reg.mu.
+	targets   []lockTarget // rows registered for the txn
+	waiting   *lockStep    // the row a blocking statement is waiting for
+	goroutine uint64       // the goroutine that last locked for the txn
+}
+
+func newTxnRegistry(p DeadlockPrevention) *txnRegistry {
+	return &txnRegistry{policy: p, holds: map[lockTarget][]txnHold{}}
+}
+
+func (r *txnRegistry) begin() *txn {
+	return &txn{reg: r, ts: r.seq.Add(1)}
+}
+
+// resume returns a txn with the timestamp of t, which has ended.
+func (r *txnRegistry) resume(t *txn) *txn {
+	return &txn{reg: r, ts: t.ts}
+}
+
+func (r *txnRegistry) add(t *txn, st lockStep) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.addLocked(t, st)
+}
+
+// addLocked registers that t holds st. r.mu must be held.
+func (r *txnRegistry) addLocked(t *txn, st lockStep) {
+	r.holds[st.target] = append(r.holds[st.target], txnHold{txn: t, step: st})
+	t.targets = append(t.targets, st.target)
+}
+
+// resolve applies the policy to the holders of st's row that conflict with
+// t. It reports whether t must die; wounds are delivered before returning.
+func (r *txnRegistry) resolve(t *txn, st lockStep) (die bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, h := range r.holds[st.target] {
+		if h.txn == t || !st.conflicts(h.step) {
+			continue
+		}
+		switch {
+		case r.policy == WaitDie && h.txn.ts < t.ts:
+			return true
+		case r.policy == WoundWait && h.txn.ts > t.ts:
+			h.txn.wounded.Store(true)
+		}
+	}
+	return false
+}
+
+// end forgets every row of t. It must be called once t's transaction has
+// ended; t may begin a new attempt afterwards.
+func (t *txn) end() {
+	if t == nil {
+		return
+	}
+	r := t.reg
+	r.mu.Lock()
+	for _, target := range t.targets {
+		holds := r.holds[target][:0]
+		for _, h := range r.holds[target] {
+			if h.txn != t {
+				holds = append(holds, h)
+			}
+		}
+		if len(holds) == 0 {
+			delete(r.holds, target)
+		} else {
+			r.holds[target] = holds
+		}
+	}
+	t.targets, t.waiting = nil, nil
+	r.mu.Unlock()
+	t.wounded.Store(false)
+}
+
+// conflicts reports whether the rows st and o lock cannot be held by two
+// transactions at once.
+func (st lockStep) conflicts(o lockStep) bool {
+	if st.slots == 0 || o.slots == 0 {
+		return st.bucketExclusive() || o.bucketExclusive()
+	}
+	if !Compatible(st.mode, o.mode) {
+		return true
+	}
+	// Two IX holders that picked the same slot.
+	return st.mode == ModeIntentExclusive && o.mode == ModeIntentExclusive && st.slot == o.slot
+}
+
+// acquireStepsPrevented acquires steps under deadlock prevention, restarting
+// in a new transaction with the same timestamp whenever the attempt dies or
+// is wounded. cfg.txn is set when a released handle is reacquired; the new
+// acquisition then keeps its timestamp.
+func (m *Manager) acquireStepsPrevented(ctx context.Context, steps []lockStep, cfg acquireConfig) (*LockHandle, error) {
+	if cfg.txn != nil {
+		cfg.txn = m.txns.resume(cfg.txn)
+	} else {
+		cfg.txn = m.txns.begin()
+	}
+	for attempt := 1; ; attempt++ {
+		h, err := m.acquireStepsOnce(ctx, steps, cfg)
+		if err == nil || !(errors.Is(err, ErrDied) || errors.Is(err, ErrWounded)) {
+			return h, err
+		}
+		if !sleepContext(ctx, restartBackoff.backoff(attempt)) {
+			return nil, errors.Join(err, ctx.Err())
+		}
+	}
+}
+
+// lockSteps locks steps in order on tx with NOWAIT probes, waiting, dying or
+// wounding according to the policy.
+func (t *txn) lockSteps(ctx context.Context, tx *sql.Tx, steps []lockStep, cfg acquireConfig) error {
+	for _, st := range steps {
+		if err := t.lockStep(ctx, tx, st, cfg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *txn) lockStep(ctx context.Context, tx *sql.Tx, st lockStep, cfg acquireConfig) error {
+	var deadline time.Time
+	if secs := cfg.lockWaitSeconds(ctx, st.target.level); secs > 0 {
+		deadline = time.Now().Add(time.Duration(secs) * time.Second)
+	}
+	err := t.probe(ctx, st, deadline, func() error {
+		return lockBucketRow(ctx, tx, st, st.bucketExclusive(), waitNoWait)
+	})
+	if err != nil {
+		return err
+	}
+	// Register the step as soon as its bucket row is held, so that a
+	// conflicting requester can die or wound t while t probes the intent
+	// rows.
+	t.reg.add(t, st)
+	return t.probe(ctx, st, deadline, func() error {
+		return lockIntentRows(ctx, tx, st, waitNoWait)
+	})
+}
+
+// probe runs lock, a NOWAIT statement for rows of st, until it succeeds,
+// applying the policy each time it would block.
+func (t *txn) probe(ctx context.Context, st lockStep, deadline time.Time, lock func() error) error {
+	fail := func(cause error) error {
+		return &LockError{Target: st.name, Level: st.target.level, Bucket: st.target.bucket, Exclusive: st.bucketExclusive(), Cause: cause}
+	}
+	backoff := minProbeBackoff
+	for {
+		if t.wounded.Load() {
+			return fail(ErrWounded)
+		}
+		err := lock()
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, ErrWouldBlock) {
+			return err
+		}
+		if t.reg.resolve(t, st) {
+			return fail(ErrDied)
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return fail(ErrLockWaitTimeout)
+		}
+		if !sleepContext(ctx, backoff) {
+			return fail(ctx.Err())
+		}
+		backoff = min(2*backoff, maxProbeBackoff)
+	}
+}
+
+// Wounded reports whether an older transaction asked the handle to give way
+// under WoundWait. The handle keeps its locks; releasing it promptly lets
+// the older transaction proceed.
+func (h *LockHandle) Wounded() bool {
+	return h != nil && h.cfg.txn != nil && h.cfg.txn.wounded.Load()
+}
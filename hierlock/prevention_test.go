@@ -0,0 +1,266 @@
+package hierlock
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTxnRegistry_Resolve(t *testing.T) {
+	st := defaultHierarchy.step(Path{"u1", "a1", "r1"}, ModeExclusive, true)
+	shared := st
+	shared.mode = ModeShared
+
+	for _, tc := range []struct {
+		policy      DeadlockPrevention
+		holderOlder bool
+		wantDie     bool
+		wantWounded bool
+	}{
+		{WaitDie, true, true, false},
+		{WaitDie, false, false, false},
+		{WoundWait, true, false, false},
+		{WoundWait, false, false, true},
+	} {
+		r := newTxnRegistry(tc.policy)
+		first, second := r.begin(), r.begin()
+		holder, requester := second, first
+		if tc.holderOlder {
+			holder, requester = first, second
+		}
+		r.add(holder, st)
+
+		if die := r.resolve(requester, st); die != tc.wantDie {
+			t.Fatalf("%v, holder older=%v: die = %v, want %v", tc.policy, tc.holderOlder, die, tc.wantDie)
+		}
+		if got := holder.wounded.Load(); got != tc.wantWounded {
+			t.Fatalf("%v, holder older=%v: wounded = %v, want %v", tc.policy, tc.holderOlder, got, tc.wantWounded)
+		}
+
+		holder.end()
+		if holder.wounded.Load() || len(r.holds) != 0 {
+			t.Fatalf("%v: end must forget the holder: %+v", tc.policy, r.holds)
+		}
+		if r.resolve(requester, st) {
+			t.Fatalf("%v: no holder left, must not die", tc.policy)
+		}
+	}
+
+	// Compatible holders are ignored whatever their age.
+	r := newTxnRegistry(WaitDie)
+	old, young := r.begin(), r.begin()
+	r.add(old, shared)
+	if r.resolve(young, shared) {
+		t.Fatalf("shared holders must not make a shared requester die")
+	}
+}
+
+func TestLockStep_Conflicts(t *testing.T) {
+	step := func(mode LockMode, slots, slot int) lockStep {
+		st := defaultHierarchy.step(Path{"u1"}, mode, true)
+		st.slots, st.slot = slots, slot
+		return st
+	}
+	if step(ModeShared, 0, 0).conflicts(step(ModeIntentExclusive, 0, 0)) {
+		t.Fatalf("without intention locks S and IX share the bucket row")
+	}
+	if !step(ModeShared, 0, 0).conflicts(step(ModeSharedIntentExclusive, 0, 0)) {
+		t.Fatalf("without intention locks SIX locks the bucket row FOR UPDATE")
+	}
+	for _, held := range allModes {
+		for _, req := range allModes {
+			if got := step(held, 4, 0).conflicts(step(req, 4, 1)); got == Compatible(held, req) {
+				t.Fatalf("conflicts(%v, %v) = %v with distinct slots", held, req, got)
+			}
+		}
+	}
+	if !step(ModeIntentExclusive, 4, 2).conflicts(step(ModeIntentExclusive, 4, 2)) {
+		t.Fatalf("IX holders on the same slot conflict")
+	}
+}
+
+func TestWithDeadlockPrevention_Option(t *testing.T) {
+	if m := NewManager(nil); m.txns != nil {
+		t.Fatalf("deadlock prevention must be off by default")
+	}
+	if m := NewManager(nil, WithDeadlockPrevention(WoundWait)); m.txns == nil || m.txns.policy != WoundWait {
+		t.Fatalf("WithDeadlockPrevention(WoundWait) not applied")
+	}
+	if m := NewManager(nil, WithDeadlockPrevention(WaitDie), WithDeadlockPrevention(0)); m.txns != nil {
+		t.Fatalf("WithDeadlockPrevention(0) must disable it")
+	}
+}
+
+// Two handles each hold one resource and then add the other's, the pattern
+// that ordered acquisition rejects. Under either policy one of them gives
+// way with ErrDied or ErrWounded, and InnoDB never reports a deadlock.
+func TestDeadlockPrevention_CrossedAddResources(t *testing.T) {
+	for _, policy := range []DeadlockPrevention{WaitDie, WoundWait} {
+		t.Run(policy.String(), func(t *testing.T) {
+			db, cleanup := openTestDB(t)
+			defer cleanup()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+			defer cancel()
+			setupLockTable(ctx, t, db)
+			r2 := pickDifferentResourceID("u1", "a1", "r1")
+			seedBuckets(ctx, t, db, mustTargets(LevelResource, "u1", "a1", "r1")...)
+			seedBuckets(ctx, t, db, resourceTarget("u1", "a1", r2))
+
+			m := NewManager(db, WithDeadlockPrevention(policy))
+			var wg sync.WaitGroup
+			errs := make(chan error, 2)
+			for _, pair := range [][2]string{{"r1", r2}, {r2, "r1"}} {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for done := 0; done < 10; {
+						h, err := m.AcquireResources(ctx, "u1", "a1", []string{pair[0]})
+						if err != nil {
+							errs <- err
+							return
+						}
+						time.Sleep(time.Millisecond)
+						err = h.AddResources(ctx, pair[1])
+						_ = h.Release()
+						switch {
+						case err == nil:
+							done++
+						case errors.Is(err, ErrDied) || errors.Is(err, ErrWounded):
+						default:
+							errs <- err
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				if isDeadlock(err) {
+					t.Fatalf("InnoDB deadlock under %v: %v", policy, err)
+				}
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestDeadlockPrevention_WoundWaitMarksYoungerHandle(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	setupLockTable(ctx, t, db)
+	r2 := pickDifferentResourceID("u1", "a1", "r1")
+	seedBuckets(ctx, t, db, mustTargets(LevelResource, "u1", "a1", "r1")...)
+	seedBuckets(ctx, t, db, resourceTarget("u1", "a1", r2))
+
+	m := NewManager(db, WithDeadlockPrevention(WoundWait))
+	old, err := m.Acquire(ctx, LevelResource, "u1", "a1", r2)
+	if err != nil {
+		t.Fatalf("acquire old: %v", err)
+	}
+	defer old.Release()
+	young, err := m.Acquire(ctx, LevelResource, "u1", "a1", "r1")
+	if err != nil {
+		t.Fatalf("acquire young: %v", err)
+	}
+
+	added := make(chan error, 1)
+	go func() { added <- old.AddResources(ctx, "r1") }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !young.Wounded() {
+		if time.Now().After(deadline) {
+			t.Fatalf("younger handle was not wounded")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := young.AddResources(ctx, r2); !errors.Is(err, ErrWounded) {
+		t.Fatalf("AddResources on a wounded handle: expected ErrWounded, got %v", err)
+	}
+	_ = young.Release()
+	if err := <-added; err != nil {
+		t.Fatalf("older AddResources: %v", err)
+	}
+}
+
+func TestDeadlockPrevention_DowngradeKeepsTimestamp(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	setupLockTable(ctx, t, db)
+	u2 := pickDifferentUserIDNonColliding("u1", "a1", "r1")
+	seedBuckets(ctx, t, db, mustTargets(LevelResource, "u1", "a1", "r1")...)
+	seedBuckets(ctx, t, db, mustTargets(LevelAccount, u2, "a1", "")...)
+
+	m := NewManager(db, WithDeadlockPrevention(WaitDie))
+	old, err := m.Acquire(ctx, LevelResource, "u1", "a1", "r1")
+	if err != nil {
+		t.Fatalf("acquire old: %v", err)
+	}
+	defer old.Release()
+	ts := old.cfg.txn.ts
+	young, err := m.Acquire(ctx, LevelAccount, u2, "a1", "")
+	if err != nil {
+		t.Fatalf("acquire young: %v", err)
+	}
+	defer young.Release()
+
+	if err := old.Downgrade(ctx); err != nil {
+		t.Fatalf("Downgrade: %v", err)
+	}
+	if got := old.cfg.txn.ts; got != ts || got >= young.cfg.txn.ts {
+		t.Fatalf("timestamp after Downgrade = %d, want %d (older than %d)", got, ts, young.cfg.txn.ts)
+	}
+}
+
+func TestDeadlockPrevention_WoundsHolderProbingIntentRows(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	setupLockTable(ctx, t, db)
+	setupIntentTable(ctx, t, db)
+	tgts := mustTargets(LevelAccount, "u1", "a1", "")
+	seedBuckets(ctx, t, db, tgts...)
+	seedIntents(ctx, t, db, 4, tgts...)
+
+	m := NewManager(db, WithIntentionLocks(4), WithDeadlockPrevention(WoundWait))
+	old, err := m.Acquire(ctx, LevelAccount, "u1", "a1", "", WithMode(ModeIntentExclusive))
+	if err != nil {
+		t.Fatalf("acquire old: %v", err)
+	}
+	defer old.Release()
+
+	// The younger reader gets the bucket row and then waits for the intent
+	// row old holds exclusively.
+	acquired := make(chan error, 1)
+	go func() {
+		h, err := m.Acquire(ctx, LevelAccount, "u1", "a1", "", WithMode(ModeShared))
+		if err == nil {
+			_ = h.Release()
+		}
+		acquired <- err
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	// Upgrading needs the bucket row FOR UPDATE, so old must wound the
+	// reader instead of waiting for it until the context ends.
+	upCtx, upCancel := context.WithTimeout(ctx, 3*time.Second)
+	defer upCancel()
+	if err := old.Upgrade(upCtx); err != nil {
+		t.Fatalf("Upgrade: %v", err)
+	}
+	_ = old.Release()
+	if err := <-acquired; err != nil {
+		t.Fatalf("younger Acquire: %v", err)
+	}
+}
@@ -0,0 +1,406 @@
+package hierlock
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis backend (RedisLocker).
+//
+// The locker plans acquisitions exactly like Manager and takes each row
+// Manager would lock, the bucket row of a (level, bucket) and with
+// WithIntentionLocks each of its intent rows, with a Lua script on three
+// keys per row:
+//
+//	hierlock:<level>:<bucket>[:i<slot>]:w  the writer's token (string)
+//	hierlock:<level>:<bucket>[:i<slot>]:r  readers' tokens, scored by lease expiry (sorted set)
+//	hierlock:<level>:<bucket>[:i<slot>]:p  a waiting writer's token (string)
+//
+// A reader is granted when there is no writer and no waiting writer; a
+// writer when there is no writer and no live reader, and otherwise it
+// leaves its token in :p so that later readers queue behind it, like
+// behind a waiting FOR UPDATE in InnoDB. Rows are taken one at a time in
+// the Manager's order, and a blocked script is retried with backoff, so the
+// (level, bucket) order keeps acquisitions free of deadlocks as before.
+//
+// The difference from the MySQL backends is that locks are leases, not
+// bound to a transaction or session: every key expires after the lease TTL
+// (WithLeaseTTL) unless renewed. Each handle renews its rows every TTL/3
+// until Release; if the process stalls or loses Redis for longer than the
+// TTL, another client can take the rows while the handle still exists.
+// RedisLockHandle.Lost reports that. Work protected by a lease must finish
+// well within the TTL, or check Lost, or be fenced by other means.
+//
+// The scripts touch the keys of several rows, so the locker needs a single
+// Redis server (or primary), not Redis Cluster. They are run with EVALSHA,
+// falling back to EVAL when the server does not have them cached yet.
+
+const (
+	// defaultLeaseTTL is the lease TTL of RedisLocker.
+	defaultLeaseTTL = 30 * time.Second
+	// minLeaseTTL bounds WithLeaseTTL from below.
+	minLeaseTTL = 100 * time.Millisecond
+	// redisReleaseTimeout bounds deleting leases, which runs without the
+	// caller's context.
+	redisReleaseTimeout = 5 * time.Second
+)
+
+// RedisLockerOption configures a RedisLocker. Every ManagerOption is a
+// RedisLockerOption that configures how acquisitions are planned (see
+// ManagerOption).
+type RedisLockerOption interface {
+	applyRedisLocker(*redisLockerConfig)
+}
+
+type redisLockerConfig struct {
+	plan []ManagerOption
+	ttl  time.Duration
+}
+
+func (o ManagerOption) applyRedisLocker(c *redisLockerConfig) {
+	c.plan = append(c.plan, o)
+}
+
+type redisLockerOption func(*redisLockerConfig)
+
+func (o redisLockerOption) applyRedisLocker(c *redisLockerConfig) {
+	o(c)
+}
+
+// WithLeaseTTL sets the lease TTL of a RedisLocker (default 30s, at least
+// 100ms).
+func WithLeaseTTL(d time.Duration) RedisLockerOption {
+	return redisLockerOption(func(c *redisLockerConfig) {
+		c.ttl = max(d, minLeaseTTL)
+	})
+}
+
+// redisAcquireScript takes row KEYS[1..3] (writer, readers, waiting writer)
+// for token ARGV[1] in mode ARGV[2] ("S" or "X") with a lease of ARGV[3]
+// milliseconds. It returns 1 when granted and 0 when the caller must wait.
+const redisAcquireScript = `
+redis.replicate_commands()
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local token, ttl = ARGV[1], tonumber(ARGV[3])
+redis.call('ZREMRANGEBYSCORE', KEYS[2], '-inf', now)
+local w = redis.call('GET', KEYS[1])
+local p = redis.call('GET', KEYS[3])
+if ARGV[2] == 'S' then
+  if (w and w ~= token) or (p and p ~= token) then
+    return 0
+  end
+  redis.call('ZADD', KEYS[2], now + ttl, token)
+  if redis.call('PTTL', KEYS[2]) < ttl then
+    redis.call('PEXPIRE', KEYS[2], ttl)
+  end
+  return 1
+end
+if p and p ~= token then
+  return 0
+end
+local readers = redis.call('ZCARD', KEYS[2])
+if redis.call('ZSCORE', KEYS[2], token) then
+  readers = readers - 1
+end
+if (w and w ~= token) or readers > 0 then
+  redis.call('SET', KEYS[3], token, 'PX', ttl)
+  return 0
+end
+redis.call('SET', KEYS[1], token, 'PX', ttl)
+if p then
+  redis.call('DEL', KEYS[3])
+end
+return 1
+`
+
+// redisRenewScript extends the leases of token ARGV[1] to ARGV[2]
+// milliseconds on rows given as key triples, with ARGV[2+i] the mode of row
+// i. It returns the number of rows the token no longer holds.
+const redisRenewScript = `
+redis.replicate_commands()
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local token, ttl = ARGV[1], tonumber(ARGV[2])
+local lost = 0
+for i = 1, #KEYS / 3 do
+  local w, r = KEYS[3 * i - 2], KEYS[3 * i - 1]
+  if ARGV[2 + i] == 'X' then
+    if redis.call('GET', w) == token then
+      redis.call('PEXPIRE', w, ttl)
+    else
+      lost = lost + 1
+    end
+  else
+    local score = redis.call('ZSCORE', r, token)
+    if score and tonumber(score) > now then
+      redis.call('ZADD', r, now + ttl, token)
+      if redis.call('PTTL', r) < ttl then
+        redis.call('PEXPIRE', r, ttl)
+      end
+    else
+      lost = lost + 1
+    end
+  end
+end
+return lost
+`
+
+// redisReleaseScript releases token ARGV[1] from rows given as key triples,
+// including a waiting writer's mark.
+const redisReleaseScript = `
+local token = ARGV[1]
+for i = 1, #KEYS / 3 do
+  local w, r, p = KEYS[3 * i - 2], KEYS[3 * i - 1], KEYS[3 * i]
+  if redis.call('GET', w) == token then
+    redis.call('DEL', w)
+  end
+  redis.call('ZREM', r, token)
+  if redis.call('GET', p) == token then
+    redis.call('DEL', p)
+  end
+end
+return 0
+`
+
+var (
+	redisAcquire = redis.NewScript(redisAcquireScript)
+	redisRenew   = redis.NewScript(redisRenewScript)
+	redisRelease = redis.NewScript(redisReleaseScript)
+)
+
+// RedisLocker is a Locker on a Redis server that keeps locks as leases.
+// See the comment above for the data model and how leases differ from row
+// locks.
+//
+// Waits end with the lock wait timeout options (ErrLockWaitTimeout) or the
+// context; the Try methods fail with ErrWouldBlock.
+type RedisLocker struct {
+	stepLocker
+	client redis.Scripter
+	ttl    time.Duration
+}
+
+var _ Locker = (*RedisLocker)(nil)
+
+// NewRedisLocker returns a RedisLocker on client, typically a
+// *redis.Client or a failover client; its redis.Options carry the address,
+// AUTH, TLS and pool settings. The client must reach a single server, not
+// a Cluster or a Ring. It is owned by the caller and is not closed by the
+// locker.
+func NewRedisLocker(client redis.Scripter, opts ...RedisLockerOption) *RedisLocker {
+	cfg := redisLockerConfig{ttl: defaultLeaseTTL}
+	for _, opt := range opts {
+		if opt != nil {
+			opt.applyRedisLocker(&cfg)
+		}
+	}
+	l := &RedisLocker{client: client, ttl: cfg.ttl}
+	l.stepLocker = stepLocker{plan: NewManager(nil, cfg.plan...), lock: l.lockSteps}
+	return l
+}
+
+// redisRow is a row held by a RedisLockHandle.
+type redisRow struct {
+	key  string // prefix of the row's keys
+	mode string // "S" or "X"
+	st   lockStep
+}
+
+func (r redisRow) keys() []string {
+	return []string{r.key + ":w", r.key + ":r", r.key + ":p"}
+}
+
+// redisRows returns the rows st locks, in order.
+func redisRows(st lockStep) []redisRow {
+	base := fmt.Sprintf("hierlock:%d:%d", int(st.target.level), st.target.bucket)
+	var rows []redisRow
+	for _, r := range st.rows() {
+		row := redisRow{key: base, mode: "S", st: st}
+		if r.slot >= 0 {
+			row.key = fmt.Sprintf("%s:i%d", base, r.slot)
+		}
+		if r.exclusive {
+			row.mode = "X"
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// RedisLockHandle holds the leases of one acquisition and renews them until
+// Release.
+type RedisLockHandle struct {
+	l     *RedisLocker
+	token string
+
+	mu   sync.Mutex
+	rows []redisRow
+
+	stop chan struct{}
+	done chan struct{}
+	lost chan struct{}
+	once sync.Once
+	err  error
+}
+
+// Lost returns a channel that is closed when a lease of the handle expired
+// before it could be renewed; from then on other clients may hold the rows.
+// The handle must still be released.
+func (h *RedisLockHandle) Lost() <-chan struct{} {
+	return h.lost
+}
+
+// Release stops renewing and deletes the handle's leases. Releasing twice
+// is a no-op.
+func (h *RedisLockHandle) Release() error {
+	if h == nil {
+		return nil
+	}
+	h.once.Do(func() {
+		close(h.stop)
+		<-h.done
+		ctx, cancel := context.WithTimeout(context.Background(), redisReleaseTimeout)
+		defer cancel()
+		h.err = h.script(ctx, redisRelease, h.heldRows(), nil)
+	})
+	return h.err
+}
+
+func (h *RedisLockHandle) heldRows() []redisRow {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]redisRow(nil), h.rows...)
+}
+
+// script runs s on the key triples of rows with ARGV token, extra...
+func (h *RedisLockHandle) script(ctx context.Context, s *redis.Script, rows []redisRow, extra []any) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, 3*len(rows))
+	for _, r := range rows {
+		keys = append(keys, r.keys()...)
+	}
+	n, err := s.Run(ctx, h.l.client, keys, append([]any{h.token}, extra...)...).Int64()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return errLeaseLost
+	}
+	return nil
+}
+
+var errLeaseLost = errors.New("hierlock: lease lost")
+
+// renew extends the leases every TTL/3 until stop is closed. It gives up
+// and closes lost once a lease is gone or renewals have failed for a whole
+// TTL.
+func (h *RedisLockHandle) renew() {
+	defer close(h.done)
+	ticker := time.NewTicker(h.l.ttl / 3)
+	defer ticker.Stop()
+	lastOK := time.Now()
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+		}
+		rows := h.heldRows()
+		extra := []any{h.l.ttl.Milliseconds()}
+		for _, r := range rows {
+			extra = append(extra, r.mode)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), h.l.ttl/3)
+		err := h.script(ctx, redisRenew, rows, extra)
+		cancel()
+		switch {
+		case err == nil:
+			lastOK = time.Now()
+			continue
+		case errors.Is(err, errLeaseLost) || time.Since(lastOK) >= h.l.ttl:
+			close(h.lost)
+			return
+		}
+	}
+}
+
+// lockSteps takes the rows of steps in order under a new token. If one
+// fails, the rows already taken are released.
+func (l *RedisLocker) lockSteps(ctx context.Context, steps []lockStep, cfg acquireConfig) (Handle, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var token [16]byte
+	if _, err := rand.Read(token[:]); err != nil {
+		return nil, err
+	}
+	h := &RedisLockHandle{
+		l:     l,
+		token: hex.EncodeToString(token[:]),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+		lost:  make(chan struct{}),
+	}
+	go h.renew()
+	for _, st := range steps {
+		var deadline time.Time
+		if secs := cfg.lockWaitSeconds(ctx, st.target.level); secs > 0 {
+			deadline = time.Now().Add(time.Duration(secs) * time.Second)
+		}
+		for _, row := range redisRows(st) {
+			if err := l.lockRow(ctx, h, row, cfg.wait, deadline); err != nil {
+				_ = h.Release()
+				return nil, err
+			}
+		}
+	}
+	return h, nil
+}
+
+func (l *RedisLocker) lockRow(ctx context.Context, h *RedisLockHandle, row redisRow, wait waitPolicy, deadline time.Time) error {
+	st := row.st
+	fail := func(cause error) error {
+		return &LockError{Target: st.name, Level: st.target.level, Bucket: st.target.bucket, Exclusive: row.mode == "X", Cause: cause}
+	}
+	// Giving up clears the waiting writer's mark the script may have left.
+	giveUp := func(cause error) error {
+		bg, cancel := context.WithTimeout(context.Background(), redisReleaseTimeout)
+		defer cancel()
+		_ = h.script(bg, redisRelease, []redisRow{row}, nil)
+		return fail(cause)
+	}
+
+	backoff := minProbeBackoff
+	for {
+		n, err := redisAcquire.Run(ctx, l.client, row.keys(), h.token, row.mode, l.ttl.Milliseconds()).Int64()
+		if err != nil {
+			return giveUp(err)
+		}
+		if n == 1 {
+			h.mu.Lock()
+			h.rows = append(h.rows, row)
+			h.mu.Unlock()
+			return nil
+		}
+		if wait == waitNoWait {
+			return giveUp(ErrWouldBlock)
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return giveUp(ErrLockWaitTimeout)
+		}
+		if !sleepContext(ctx, backoff) {
+			return giveUp(ctx.Err())
+		}
+		backoff = min(2*backoff, maxProbeBackoff)
+	}
+}
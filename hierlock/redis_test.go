@@ -0,0 +1,155 @@
+package hierlock
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func openTestRedis(t fataler) (*redis.Client, func()) {
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		// docker-compose.yml defaults
+		addr = "127.0.0.1:6379"
+	}
+	// Probe without retries so that an unreachable server is skipped fast.
+	probe := redis.NewClient(&redis.Options{Addr: addr, MaxRetries: -1, DialerRetries: 1})
+	defer probe.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := probe.Ping(ctx).Err(); err != nil {
+		t.Skipf("Redis not reachable (set REDIS_ADDR or run docker-compose up -d): %v", err)
+	}
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	return client, func() { _ = client.Close() }
+}
+
+func TestNewRedisLocker_Options(t *testing.T) {
+	if l := NewRedisLocker(nil); l.ttl != defaultLeaseTTL {
+		t.Fatalf("default TTL = %v, want %v", l.ttl, defaultLeaseTTL)
+	}
+	l := NewRedisLocker(nil, WithGlobalLock(), WithLeaseTTL(time.Millisecond), nil)
+	if l.ttl != minLeaseTTL {
+		t.Fatalf("TTL = %v, want the minimum %v", l.ttl, minLeaseTTL)
+	}
+	if !l.plan.global {
+		t.Fatalf("ManagerOptions must configure the plan")
+	}
+}
+
+func TestRedisLocker_TryAcquireAndWriterQueue(t *testing.T) {
+	client, cleanup := openTestRedis(t)
+	defer cleanup()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	l := NewRedisLocker(client)
+	reader, err := l.Acquire(ctx, LevelAccount, "u1", "a1", "", WithMode(ModeShared))
+	if err != nil {
+		t.Fatalf("shared Acquire: %v", err)
+	}
+	defer reader.Release()
+	var le *LockError
+	_, err = l.TryAcquire(ctx, LevelAccount, "u1", "a1", "")
+	if !errors.Is(err, ErrWouldBlock) || !errors.As(err, &le) || le.Target != "Account(u1/a1)" {
+		t.Fatalf("expected ErrWouldBlock on Account(u1/a1), got %v", err)
+	}
+
+	// A waiting writer makes later readers queue behind it.
+	writer := make(chan error, 1)
+	go func() {
+		h, err := l.Acquire(ctx, LevelAccount, "u1", "a1", "")
+		if err == nil {
+			defer h.Release()
+		}
+		writer <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if _, err := l.TryAcquire(ctx, LevelAccount, "u1", "a1", "", WithMode(ModeShared)); !errors.Is(err, ErrWouldBlock) {
+		t.Fatalf("reader behind a waiting writer: expected ErrWouldBlock, got %v", err)
+	}
+	_ = reader.Release()
+	if err := <-writer; err != nil {
+		t.Fatalf("writer: %v", err)
+	}
+
+	start := time.Now()
+	holder, err := l.Acquire(ctx, LevelUser, "u1", "", "")
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	defer holder.Release()
+	_, err = l.Acquire(ctx, LevelResource, "u1", "a1", "r1", WithLockWaitTimeout(time.Second))
+	if !errors.Is(err, ErrLockWaitTimeout) || time.Since(start) < time.Second {
+		t.Fatalf("expected ErrLockWaitTimeout after 1s, got %v after %v", err, time.Since(start))
+	}
+}
+
+func TestRedisLocker_LeasesExpireWithoutRenewal(t *testing.T) {
+	client, cleanup := openTestRedis(t)
+	defer cleanup()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	ttl := 300 * time.Millisecond
+	l := NewRedisLocker(client, WithLeaseTTL(ttl))
+	h, err := l.Acquire(ctx, LevelAccount, "u1", "a1", "")
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	defer h.Release()
+
+	// Renewal keeps the lease well past its TTL.
+	time.Sleep(3 * ttl)
+	if _, err := l.TryAcquire(ctx, LevelAccount, "u1", "a1", ""); !errors.Is(err, ErrWouldBlock) {
+		t.Fatalf("renewed lease: expected ErrWouldBlock, got %v", err)
+	}
+
+	// A stalled holder loses it: unlike a row lock, the account is free
+	// again while the handle still exists.
+	rh := h.(*RedisLockHandle)
+	close(rh.stop)
+	<-rh.done
+	rh.stop = make(chan struct{}) // let Release close it again
+	time.Sleep(2 * ttl)
+	h2, err := l.TryAcquire(ctx, LevelAccount, "u1", "a1", "")
+	if err != nil {
+		t.Fatalf("expired lease: %v", err)
+	}
+	defer h2.Release()
+	// Releasing the stale handle leaves the new holder alone.
+	if err := h.Release(); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if _, err := l.TryAcquire(ctx, LevelAccount, "u1", "a1", ""); !errors.Is(err, ErrWouldBlock) {
+		t.Fatalf("new holder lost its lease: %v", err)
+	}
+}
+
+func TestRedisLocker_LostReportsTakenLeases(t *testing.T) {
+	client, cleanup := openTestRedis(t)
+	defer cleanup()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	l := NewRedisLocker(client, WithLeaseTTL(300*time.Millisecond))
+	h, err := l.Acquire(ctx, LevelAccount, "u1", "a1", "")
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	defer h.Release()
+
+	rh := h.(*RedisLockHandle)
+	if err := client.Del(ctx, rh.heldRows()[len(rh.heldRows())-1].key+":w").Err(); err != nil {
+		t.Fatalf("DEL: %v", err)
+	}
+	select {
+	case <-rh.Lost():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Lost was not closed after the lease disappeared")
+	}
+}
@@ -8,27 +8,189 @@ import (
 // Repository is a thin wrapper that exposes lock acquisition methods
 // aligned with typical application code usage.
 //
-// It intentionally does not try to hide the LockHandle; callers must Release().
+// It is typed for the default User -> Account -> Resource hierarchy; use
+// Manager.AcquirePath for other hierarchies.
+//
+// It intentionally does not try to hide the LockHandle; callers must
+// Release(). It is the LockerRepository of a Manager's Locker, with the
+// handles typed as *LockHandle.
 type Repository struct {
-	m *Manager
+	lr LockerRepository
+}
+
+func NewRepository(db *sql.DB, opts ...ManagerOption) *Repository {
+	return &Repository{lr: LockerRepository{l: NewManager(db, opts...).Locker()}}
+}
+
+// lockHandle converts the result of a LockerRepository method on a
+// Manager's Locker, whose handles are *LockHandle.
+func lockHandle(h Handle, err error) (*LockHandle, error) {
+	if err != nil {
+		return nil, err
+	}
+	return h.(*LockHandle), nil
+}
+
+func (r *Repository) GetUserLock(ctx context.Context, userID string, opts ...AcquireOption) (*LockHandle, error) {
+	return lockHandle(r.lr.GetUserLock(ctx, userID, opts...))
+}
+
+func (r *Repository) GetAccountLock(ctx context.Context, userID, accountID string, opts ...AcquireOption) (*LockHandle, error) {
+	return lockHandle(r.lr.GetAccountLock(ctx, userID, accountID, opts...))
+}
+
+func (r *Repository) GetAccountsLock(ctx context.Context, userID string, accountIDs []string, opts ...AcquireOption) (*LockHandle, error) {
+	return lockHandle(r.lr.GetAccountsLock(ctx, userID, accountIDs, opts...))
+}
+
+func (r *Repository) GetResourceLock(ctx context.Context, userID, accountID, resourceID string, opts ...AcquireOption) (*LockHandle, error) {
+	return lockHandle(r.lr.GetResourceLock(ctx, userID, accountID, resourceID, opts...))
+}
+
+func (r *Repository) GetResourcesLock(ctx context.Context, userID, accountID string, resourceIDs []string, opts ...AcquireOption) (*LockHandle, error) {
+	return lockHandle(r.lr.GetResourcesLock(ctx, userID, accountID, resourceIDs, opts...))
+}
+
+func (r *Repository) TryGetUserLock(ctx context.Context, userID string, opts ...AcquireOption) (*LockHandle, error) {
+	return lockHandle(r.lr.TryGetUserLock(ctx, userID, opts...))
+}
+
+func (r *Repository) TryGetAccountLock(ctx context.Context, userID, accountID string, opts ...AcquireOption) (*LockHandle, error) {
+	return lockHandle(r.lr.TryGetAccountLock(ctx, userID, accountID, opts...))
+}
+
+func (r *Repository) TryGetAccountsLock(ctx context.Context, userID string, accountIDs []string, opts ...AcquireOption) (*LockHandle, error) {
+	return lockHandle(r.lr.TryGetAccountsLock(ctx, userID, accountIDs, opts...))
+}
+
+func (r *Repository) TryGetResourceLock(ctx context.Context, userID, accountID, resourceID string, opts ...AcquireOption) (*LockHandle, error) {
+	return lockHandle(r.lr.TryGetResourceLock(ctx, userID, accountID, resourceID, opts...))
+}
+
+func (r *Repository) TryGetResourcesLock(ctx context.Context, userID, accountID string, resourceIDs []string, opts ...AcquireOption) (*LockHandle, error) {
+	return lockHandle(r.lr.TryGetResourcesLock(ctx, userID, accountID, resourceIDs, opts...))
+}
+
+func (r *Repository) GetTransferLock(ctx context.Context, from, to LockRequest, opts ...AcquireOption) (*LockHandle, error) {
+	return lockHandle(r.lr.GetTransferLock(ctx, from, to, opts...))
+}
+
+func (r *Repository) TryGetTransferLock(ctx context.Context, from, to LockRequest, opts ...AcquireOption) (*LockHandle, error) {
+	return lockHandle(r.lr.TryGetTransferLock(ctx, from, to, opts...))
+}
+
+// LockerRepository has the methods of Repository on any Locker, for code
+// that swaps backends or fakes the Locker in tests. Its handles are those of
+// the Locker, *LockHandle for Manager.Locker.
+//
+// GetAccountsLock and GetTransferLock lock their targets with AcquireSet,
+// or with Manager.AcquireAccounts and Manager.AcquireTransfer when the
+// Locker is a Manager's.
+type LockerRepository struct {
+	l Locker
+}
+
+func NewLockerRepository(l Locker) *LockerRepository {
+	return &LockerRepository{l: l}
+}
+
+// manager returns the Manager behind r's Locker, or nil.
+func (r *LockerRepository) manager() *Manager {
+	if ml, ok := r.l.(managerLocker); ok {
+		return ml.m
+	}
+	return nil
+}
+
+func (r *LockerRepository) GetUserLock(ctx context.Context, userID string, opts ...AcquireOption) (Handle, error) {
+	return r.l.Acquire(ctx, LevelUser, userID, "", "", opts...)
+}
+
+func (r *LockerRepository) GetAccountLock(ctx context.Context, userID, accountID string, opts ...AcquireOption) (Handle, error) {
+	return r.l.Acquire(ctx, LevelAccount, userID, accountID, "", opts...)
+}
+
+func (r *LockerRepository) GetAccountsLock(ctx context.Context, userID string, accountIDs []string, opts ...AcquireOption) (Handle, error) {
+	if m := r.manager(); m != nil {
+		return handle(m.AcquireAccounts(ctx, userID, accountIDs, opts...))
+	}
+	reqs, err := accountRequests(userID, accountIDs, opts)
+	if err != nil {
+		return nil, err
+	}
+	return r.l.AcquireSet(ctx, reqs, opts...)
+}
+
+func (r *LockerRepository) GetResourceLock(ctx context.Context, userID, accountID, resourceID string, opts ...AcquireOption) (Handle, error) {
+	return r.l.Acquire(ctx, LevelResource, userID, accountID, resourceID, opts...)
+}
+
+func (r *LockerRepository) GetResourcesLock(ctx context.Context, userID, accountID string, resourceIDs []string, opts ...AcquireOption) (Handle, error) {
+	return r.l.AcquireResources(ctx, userID, accountID, resourceIDs, opts...)
+}
+
+func (r *LockerRepository) TryGetUserLock(ctx context.Context, userID string, opts ...AcquireOption) (Handle, error) {
+	return r.l.TryAcquire(ctx, LevelUser, userID, "", "", opts...)
+}
+
+func (r *LockerRepository) TryGetAccountLock(ctx context.Context, userID, accountID string, opts ...AcquireOption) (Handle, error) {
+	return r.l.TryAcquire(ctx, LevelAccount, userID, accountID, "", opts...)
+}
+
+func (r *LockerRepository) TryGetAccountsLock(ctx context.Context, userID string, accountIDs []string, opts ...AcquireOption) (Handle, error) {
+	if m := r.manager(); m != nil {
+		return handle(m.TryAcquireAccounts(ctx, userID, accountIDs, opts...))
+	}
+	reqs, err := accountRequests(userID, accountIDs, opts)
+	if err != nil {
+		return nil, err
+	}
+	return r.l.TryAcquireSet(ctx, reqs, opts...)
 }
 
-func NewRepository(db *sql.DB) *Repository {
-	return &Repository{m: NewManager(db)}
+func (r *LockerRepository) TryGetResourceLock(ctx context.Context, userID, accountID, resourceID string, opts ...AcquireOption) (Handle, error) {
+	return r.l.TryAcquire(ctx, LevelResource, userID, accountID, resourceID, opts...)
 }
 
-func (r *Repository) GetUserLock(ctx context.Context, userID string) (*LockHandle, error) {
-	return r.m.Acquire(ctx, LevelUser, userID, "", "")
+func (r *LockerRepository) TryGetResourcesLock(ctx context.Context, userID, accountID string, resourceIDs []string, opts ...AcquireOption) (Handle, error) {
+	return r.l.TryAcquireResources(ctx, userID, accountID, resourceIDs, opts...)
 }
 
-func (r *Repository) GetAccountLock(ctx context.Context, userID, accountID string) (*LockHandle, error) {
-	return r.m.Acquire(ctx, LevelAccount, userID, accountID, "")
+func (r *LockerRepository) GetTransferLock(ctx context.Context, from, to LockRequest, opts ...AcquireOption) (Handle, error) {
+	if m := r.manager(); m != nil {
+		return handle(m.AcquireTransfer(ctx, from, to, opts...))
+	}
+	reqs, err := transferRequests(from, to)
+	if err != nil {
+		return nil, err
+	}
+	return r.l.AcquireSet(ctx, reqs, opts...)
 }
 
-func (r *Repository) GetResourceLock(ctx context.Context, userID, accountID, resourceID string) (*LockHandle, error) {
-	return r.m.Acquire(ctx, LevelResource, userID, accountID, resourceID)
+func (r *LockerRepository) TryGetTransferLock(ctx context.Context, from, to LockRequest, opts ...AcquireOption) (Handle, error) {
+	if m := r.manager(); m != nil {
+		return handle(m.TryAcquireTransfer(ctx, from, to, opts...))
+	}
+	reqs, err := transferRequests(from, to)
+	if err != nil {
+		return nil, err
+	}
+	return r.l.TryAcquireSet(ctx, reqs, opts...)
 }
 
-func (r *Repository) GetResourcesLock(ctx context.Context, userID, accountID string, resourceIDs []string) (*LockHandle, error) {
-	return r.m.AcquireResources(ctx, userID, accountID, resourceIDs)
+// accountRequests returns the Accounts of GetAccountsLock as a lock set in
+// the mode of opts.
+func accountRequests(userID string, accountIDs []string, opts []AcquireOption) ([]LockRequest, error) {
+	if err := validateAccounts(userID, accountIDs); err != nil {
+		return nil, err
+	}
+	cfg, err := newAcquireConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	reqs := make([]LockRequest, 0, len(accountIDs))
+	for _, a := range accountIDs {
+		reqs = append(reqs, LockRequest{Level: LevelAccount, UserID: userID, AccountID: a, Mode: cfg.mode})
+	}
+	return reqs, nil
 }
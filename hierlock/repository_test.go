@@ -44,9 +44,38 @@ func TestRepository_LockMethods(t *testing.T) {
 	if err != nil {
 		t.Fatalf("GetResourcesLock: %v", err)
 	}
+	if n := len(h4.Held()); n != 4 {
+		t.Fatalf("GetResourcesLock holds %d rows, want 4", n)
+	}
 	_ = h4.Release()
 }
 
+func TestLockerRepository_ManagerHandles(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	setupLockTable(ctx, t, db)
+	a2 := pickDifferentAccountIDNonCollidingResource("u1", "a1", "r1")
+	seedBuckets(ctx, t, db, mustTargets(LevelAccount, "u1", "a1", "")...)
+	seedBuckets(ctx, t, db, accountTarget("u1", a2))
+
+	repo := NewLockerRepository(NewManager(db).Locker())
+	h, err := repo.GetAccountsLock(ctx, "u1", []string{"a1", a2})
+	if err != nil {
+		t.Fatalf("GetAccountsLock: %v", err)
+	}
+	defer h.Release()
+	lh, ok := h.(*LockHandle)
+	if !ok {
+		t.Fatalf("handle is %T, want *LockHandle", h)
+	}
+	if n := len(lh.Held()); n != 3 {
+		t.Fatalf("GetAccountsLock holds %d rows, want the User and 2 Accounts", n)
+	}
+}
+
 func TestBucketKeyRange(t *testing.T) {
 	tgt := userTarget("some-user")
 	if tgt.level != LevelUser {
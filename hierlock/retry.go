@@ -0,0 +1,146 @@
+package hierlock
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"time"
+)
+
+// RetryPolicy retries acquisitions that fail with a transient error such as a
+// deadlock (1213) or a lock wait timeout (1205). Every attempt runs in a fresh
+// lock transaction; the failed one has already been rolled back.
+//
+// The zero value makes a single attempt.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first.
+	// Values below 1 mean 1.
+	MaxAttempts int
+
+	// InitialBackoff is the delay before the second attempt. Each further
+	// delay is multiplied by Multiplier (default 2) and capped at MaxBackoff
+	// (0 means no cap).
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+
+	// Jitter randomizes each delay by up to ±Jitter of its value (0..1).
+	Jitter float64
+
+	// Budget bounds the total time spent, including delays. A retry is not
+	// started if its delay would end after the budget. 0 means unlimited.
+	// The budget never cancels an attempt that is already running.
+	Budget time.Duration
+
+	// ShouldRetry decides whether an error is worth another attempt. code is
+	// the MySQL error number in err's chain, or 0. The default retries 1205
+	// and 1213 (see DefaultShouldRetry).
+	ShouldRetry func(code uint16, err error) bool
+
+	// OnRetry, if set, is called before waiting for the next attempt.
+	// attempt is the number of the attempt that just failed (1-based).
+	OnRetry func(attempt int, err error, delay time.Duration)
+
+	// OnDone, if set, is called once with the number of attempts made and
+	// the final error (nil on success).
+	OnDone func(attempts int, err error)
+}
+
+// DefaultRetryPolicy returns a policy suitable for deadlock and lock wait
+// timeout retries: 5 attempts, 10ms..500ms exponential backoff with 20% jitter.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    5,
+		InitialBackoff: 10 * time.Millisecond,
+		MaxBackoff:     500 * time.Millisecond,
+		Multiplier:     2,
+		Jitter:         0.2,
+	}
+}
+
+// DefaultShouldRetry retries deadlocks (1213, or a *DeadlockError detected
+// in process) and lock wait timeouts (1205, or ErrLockWaitTimeout from a
+// wait the manager bounds itself, as under WithDeadlockPrevention).
+func DefaultShouldRetry(code uint16, err error) bool {
+	var de *DeadlockError
+	return code == errLockDeadlock || code == errLockWaitTimeout || errors.As(err, &de) || errors.Is(err, ErrLockWaitTimeout)
+}
+
+// Do calls fn until it succeeds, returns a non-retryable error, or the policy
+// runs out of attempts or budget. It returns fn's last error.
+func (p RetryPolicy) Do(ctx context.Context, fn func(ctx context.Context) error) error {
+	shouldRetry := p.ShouldRetry
+	if shouldRetry == nil {
+		shouldRetry = DefaultShouldRetry
+	}
+	maxAttempts := p.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+
+	start := time.Now()
+	attempt := 0
+	var err error
+	for {
+		attempt++
+		err = fn(ctx)
+		if err == nil || attempt >= maxAttempts || !shouldRetry(mysqlErrorNumber(err), err) {
+			break
+		}
+		delay := p.backoff(attempt)
+		if p.Budget > 0 && time.Since(start)+delay > p.Budget {
+			break
+		}
+		if p.OnRetry != nil {
+			p.OnRetry(attempt, err, delay)
+		}
+		if !sleepContext(ctx, delay) {
+			break
+		}
+	}
+	if p.OnDone != nil {
+		p.OnDone(attempt, err)
+	}
+	return err
+}
+
+// backoff returns the delay after the given failed attempt (1-based).
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	mult := p.Multiplier
+	if mult <= 0 {
+		mult = 2
+	}
+	d := float64(p.InitialBackoff)
+	for i := 1; i < attempt; i++ {
+		d *= mult
+		if p.MaxBackoff > 0 && d >= float64(p.MaxBackoff) {
+			break
+		}
+	}
+	if p.MaxBackoff > 0 && d > float64(p.MaxBackoff) {
+		d = float64(p.MaxBackoff)
+	}
+	if p.Jitter > 0 {
+		d += d * p.Jitter * (2*rand.Float64() - 1)
+	}
+	if d < 0 {
+		return 0
+	}
+	return time.Duration(d)
+}
+
+// sleepContext waits for d or until ctx is done; it reports whether the full
+// delay elapsed.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
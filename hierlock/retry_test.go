@@ -0,0 +1,257 @@
+package hierlock
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestRetryPolicy_RetriesTransientErrors(t *testing.T) {
+	deadlock := &LockError{Level: LevelResource, Bucket: 1, Exclusive: true, Cause: &mysql.MySQLError{Number: errLockDeadlock}}
+
+	var retries []int
+	var doneAttempts int
+	p := RetryPolicy{
+		MaxAttempts:    5,
+		InitialBackoff: time.Millisecond,
+		OnRetry: func(attempt int, err error, delay time.Duration) {
+			if !errors.Is(err, ErrDeadlock) {
+				t.Errorf("OnRetry got unexpected error: %v", err)
+			}
+			retries = append(retries, attempt)
+		},
+		OnDone: func(attempts int, err error) {
+			doneAttempts = attempts
+		},
+	}
+
+	calls := 0
+	err := p.Do(context.Background(), func(ctx context.Context) error {
+		calls++
+		if calls < 3 {
+			return deadlock
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+	if calls != 3 || doneAttempts != 3 {
+		t.Fatalf("calls=%d doneAttempts=%d, want 3", calls, doneAttempts)
+	}
+	if len(retries) != 2 || retries[0] != 1 || retries[1] != 2 {
+		t.Fatalf("OnRetry attempts = %v, want [1 2]", retries)
+	}
+}
+
+func TestRetryPolicy_StopsOnNonRetryableAndLimits(t *testing.T) {
+	ctx := context.Background()
+	wouldBlock := &LockError{Cause: &mysql.MySQLError{Number: errLockNoWait}}
+	timeout := &LockError{Cause: &mysql.MySQLError{Number: errLockWaitTimeout}}
+
+	count := func(p RetryPolicy, err error) int {
+		calls := 0
+		_ = p.Do(ctx, func(ctx context.Context) error {
+			calls++
+			return err
+		})
+		return calls
+	}
+
+	if got := count(RetryPolicy{MaxAttempts: 5}, wouldBlock); got != 1 {
+		t.Fatalf("non-retryable error: %d attempts, want 1", got)
+	}
+	if got := count(RetryPolicy{}, timeout); got != 1 {
+		t.Fatalf("zero policy: %d attempts, want 1", got)
+	}
+	if got := count(RetryPolicy{MaxAttempts: 3}, timeout); got != 3 {
+		t.Fatalf("max attempts: %d attempts, want 3", got)
+	}
+	probed := &LockError{Target: "Account(u1/a1)", Cause: ErrLockWaitTimeout}
+	if got := count(RetryPolicy{MaxAttempts: 3}, probed); got != 3 {
+		t.Fatalf("timeout without a MySQL code: %d attempts, want 3", got)
+	}
+	custom := RetryPolicy{
+		MaxAttempts: 3,
+		ShouldRetry: func(code uint16, err error) bool { return code == errLockNoWait },
+	}
+	if got := count(custom, wouldBlock); got != 3 {
+		t.Fatalf("custom ShouldRetry: %d attempts, want 3", got)
+	}
+	budget := RetryPolicy{MaxAttempts: 100, InitialBackoff: 20 * time.Millisecond, Budget: 50 * time.Millisecond}
+	if got := count(budget, timeout); got >= 100 || got < 2 {
+		t.Fatalf("budget: %d attempts, want the budget to stop retries early", got)
+	}
+}
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	p := RetryPolicy{InitialBackoff: 10 * time.Millisecond, MaxBackoff: 35 * time.Millisecond}
+	want := []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 35 * time.Millisecond, 35 * time.Millisecond}
+	for i, w := range want {
+		if got := p.backoff(i + 1); got != w {
+			t.Fatalf("backoff(%d) = %v, want %v", i+1, got, w)
+		}
+	}
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if got := p.backoff(1); got < 5*time.Millisecond || got > 15*time.Millisecond {
+			t.Fatalf("jittered backoff %v out of range", got)
+		}
+	}
+}
+
+func TestManager_RetryPolicyRetriesLockWaitTimeout(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	setupLockTable(ctx, t, db)
+	seedBuckets(ctx, t, db, mustTargets(LevelAccount, "u1", "a1", "")...)
+
+	attempts := 0
+	m := NewManager(db, WithRetryPolicy(RetryPolicy{
+		MaxAttempts:    5,
+		InitialBackoff: 10 * time.Millisecond,
+		OnDone:         func(n int, err error) { attempts = n },
+	}))
+
+	holder, err := m.Acquire(ctx, LevelAccount, "u1", "a1", "")
+	if err != nil {
+		t.Fatalf("holder acquire: %v", err)
+	}
+	go func() {
+		time.Sleep(1500 * time.Millisecond)
+		_ = holder.Release()
+	}()
+
+	// Each attempt gives up after 1s on the server; the holder leaves during
+	// the second attempt.
+	attempts = 0
+	h, err := m.Acquire(ctx, LevelAccount, "u1", "a1", "", WithLockWaitTimeout(time.Second))
+	if err != nil {
+		t.Fatalf("acquire under retry: %v", err)
+	}
+	defer h.Release()
+	if attempts < 2 {
+		t.Fatalf("attempts = %d, want at least one retry", attempts)
+	}
+}
+
+func TestManager_RetryPolicyRetriesDeadlockInFreshTransaction(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	setupLockTable(ctx, t, db)
+	seedBuckets(ctx, t, db, mustTargets(LevelResource, "u1", "a1", "r1")...)
+	var pads []lockTarget
+	for i := range 50 {
+		pads = append(pads, resourceTarget("u9", "a9", fmt.Sprintf("pad%d", i)))
+	}
+	seedBuckets(ctx, t, db, pads...)
+
+	var retries []int
+	doneAttempts := 0
+	var doneErr error
+	m := NewManager(db, WithRetryPolicy(RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: 10 * time.Millisecond,
+		OnRetry: func(attempt int, err error, delay time.Duration) {
+			if !errors.Is(err, ErrDeadlock) {
+				t.Errorf("OnRetry got %v, want ErrDeadlock", err)
+			}
+			retries = append(retries, attempt)
+		},
+		OnDone: func(attempts int, err error) { doneAttempts, doneErr = attempts, err },
+	}))
+
+	// A transaction outside the manager holds r1 and many other rows, so
+	// that InnoDB picks the manager's lighter transaction as the victim.
+	other, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelReadCommitted})
+	if err != nil {
+		t.Fatalf("begin: %v", err)
+	}
+	defer other.Rollback()
+	for _, tgt := range append(pads, resourceTarget("u1", "a1", "r1")) {
+		if err := lockRow(ctx, other, tgt, true); err != nil {
+			t.Fatalf("lock %+v: %v", tgt, err)
+		}
+	}
+
+	type result struct {
+		h   *LockHandle
+		err error
+	}
+	acquired := make(chan result, 1)
+	go func() {
+		h, err := m.AcquireResources(ctx, "u1", "a1", []string{"r1"})
+		acquired <- result{h, err}
+	}()
+	// The first attempt holds the Account shared and waits for r1; locking
+	// the Account exclusively closes the cycle.
+	time.Sleep(300 * time.Millisecond)
+	if err := lockRow(ctx, other, accountTarget("u1", "a1"), true); err != nil {
+		t.Fatalf("the other transaction was chosen as the victim: %v", err)
+	}
+	_ = other.Rollback()
+
+	res := <-acquired
+	if res.err != nil {
+		t.Fatalf("AcquireResources under retry: %v", res.err)
+	}
+	defer res.h.Release()
+	if len(res.h.Held()) != 3 {
+		t.Fatalf("the retried attempt holds %v, want User, Account and r1", res.h.Held())
+	}
+	if len(retries) != 1 || retries[0] != 1 {
+		t.Fatalf("OnRetry attempts = %v, want [1]", retries)
+	}
+	if doneAttempts != 2 || doneErr != nil {
+		t.Fatalf("OnDone got %d attempts and %v, want 2 and nil", doneAttempts, doneErr)
+	}
+}
+
+func TestManager_RetryPolicyRetriesPreventedLockWaitTimeout(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	setupLockTable(ctx, t, db)
+	seedBuckets(ctx, t, db, mustTargets(LevelAccount, "u1", "a1", "")...)
+
+	attempts := 0
+	m := NewManager(db, WithDeadlockPrevention(WaitDie), WithRetryPolicy(RetryPolicy{
+		MaxAttempts:    5,
+		InitialBackoff: 10 * time.Millisecond,
+		OnDone:         func(n int, err error) { attempts = n },
+	}))
+
+	// The holder is outside the manager, so the probes wait for it until the
+	// lock wait timeout.
+	holder, err := NewManager(db).Acquire(ctx, LevelAccount, "u1", "a1", "")
+	if err != nil {
+		t.Fatalf("holder acquire: %v", err)
+	}
+	go func() {
+		time.Sleep(1500 * time.Millisecond)
+		_ = holder.Release()
+	}()
+
+	h, err := m.Acquire(ctx, LevelAccount, "u1", "a1", "", WithLockWaitTimeout(time.Second))
+	if err != nil {
+		t.Fatalf("acquire under retry: %v", err)
+	}
+	defer h.Release()
+	if attempts < 2 {
+		t.Fatalf("attempts = %d, want at least one retry", attempts)
+	}
+}
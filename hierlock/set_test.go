@@ -0,0 +1,162 @@
+package hierlock
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAcquireSet_ExpandsAndMergesAncestors(t *testing.T) {
+	m := NewManager(nil)
+	reqs := []LockRequest{
+		{Level: LevelResource, UserID: "u1", AccountID: "a1", ResourceID: "r1"},
+		{Level: LevelAccount, UserID: "u1", AccountID: "a1"},
+		{Level: LevelResource, UserID: "u2", AccountID: "a9", ResourceID: "r3"},
+		{Level: LevelResource, UserID: "u2", AccountID: "a9", ResourceID: "r4", Mode: ModeShared},
+	}
+	steps, err := m.setSteps(reqs)
+	if err != nil {
+		t.Fatalf("setSteps: %v", err)
+	}
+	planned, _ := planSteps(steps)
+
+	got := map[string]LockMode{}
+	for _, st := range planned {
+		if _, dup := got[st.name]; dup {
+			t.Fatalf("%s locked twice", st.name)
+		}
+		got[st.name] = st.mode
+	}
+	want := map[string]LockMode{
+		"User(u1)":           ModeShared,
+		"User(u2)":           ModeShared,
+		"Account(u1/a1)":     ModeExclusive, // requested X wins over the shared ancestor of r1
+		"Account(u2/a9)":     ModeShared,
+		"Resource(u1/a1/r1)": ModeExclusive,
+		"Resource(u2/a9/r3)": ModeExclusive,
+		"Resource(u2/a9/r4)": ModeShared,
+	}
+	if len(got) != len(want) {
+		t.Fatalf("planned %v, want %v", got, want)
+	}
+	for name, mode := range want {
+		if got[name] != mode {
+			t.Fatalf("%s mode = %v, want %v (all: %v)", name, got[name], mode, got)
+		}
+	}
+	if !slices.IsSortedFunc(planned, func(a, b lockStep) int {
+		if a.target.less(b.target) {
+			return -1
+		}
+		return 1
+	}) {
+		t.Fatalf("steps not in (level, bucket) order")
+	}
+
+	for _, bad := range [][]LockRequest{
+		nil,
+		{{Level: LevelResource, UserID: "u1", AccountID: "a1"}},
+		{{Level: LevelUser, UserID: "u1", Mode: LockMode(42)}},
+	} {
+		if _, err := m.setSteps(bad); !errors.Is(err, ErrInvalidArgument) {
+			t.Fatalf("setSteps(%+v): expected ErrInvalidArgument, got %v", bad, err)
+		}
+	}
+}
+
+func TestAcquireSet_LocksMixedTargets(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	setupLockTable(ctx, t, db)
+
+	r3 := "r3"
+	r4 := pickDifferentResourceID("u2", "a9", r3)
+	r5 := pickDifferentResourceID("u2", "a9", r4)
+	for _, r := range []string{r3, r4, r5} {
+		seedBuckets(ctx, t, db, mustTargets(LevelResource, "u2", "a9", r)...)
+	}
+	seedBuckets(ctx, t, db, mustTargets(LevelResource, "u1", "a1", "r1")...)
+
+	m := NewManager(db)
+	h, err := m.AcquireSet(ctx, []LockRequest{
+		{Level: LevelAccount, UserID: "u1", AccountID: "a1"},
+		{Level: LevelResource, UserID: "u2", AccountID: "a9", ResourceID: r3},
+		{Level: LevelResource, UserID: "u2", AccountID: "a9", ResourceID: r4},
+	})
+	if err != nil {
+		t.Fatalf("AcquireSet: %v", err)
+	}
+	defer h.Release()
+
+	for _, busy := range [][4]string{
+		{"account", "u1", "a1", ""},
+		{"resource", "u1", "a1", "r1"},
+		{"resource", "u2", "a9", r3},
+		{"resource", "u2", "a9", r4},
+	} {
+		level := LevelResource
+		if busy[0] == "account" {
+			level = LevelAccount
+		}
+		if o, err := m.TryAcquire(ctx, level, busy[1], busy[2], busy[3]); !errors.Is(err, ErrWouldBlock) {
+			if err == nil {
+				_ = o.Release()
+			}
+			t.Fatalf("%v: expected ErrWouldBlock, got %v", busy, err)
+		}
+	}
+	free, err := m.TryAcquire(ctx, LevelResource, "u2", "a9", r5)
+	if err != nil {
+		t.Fatalf("sibling outside the set should be free: %v", err)
+	}
+	_ = free.Release()
+}
+
+func TestAcquireSet_OppositeRequestOrdersDoNotDeadlock(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	setupLockTable(ctx, t, db)
+
+	u2 := pickDifferentUserIDNonColliding("u1", "a1", "r1")
+	seedBuckets(ctx, t, db, mustTargets(LevelResource, "u1", "a1", "r1")...)
+	seedBuckets(ctx, t, db, mustTargets(LevelResource, u2, "a1", "r1")...)
+
+	set := []LockRequest{
+		{Level: LevelResource, UserID: "u1", AccountID: "a1", ResourceID: "r1"},
+		{Level: LevelAccount, UserID: u2, AccountID: "a1"},
+	}
+	reversed := slices.Clone(set)
+	slices.Reverse(reversed)
+
+	m := NewManager(db)
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	for _, reqs := range [][]LockRequest{set, reversed} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				h, err := m.AcquireSet(ctx, reqs, WithLockWaitTimeout(5*time.Second))
+				if err != nil {
+					errs <- err
+					return
+				}
+				_ = h.Release()
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("AcquireSet: %v", err)
+	}
+}
@@ -86,6 +86,37 @@ func seedBuckets(ctx context.Context, t fataler, db *sql.DB, targets ...lockTarg
 	}
 }
 
+func setupIntentTable(ctx context.Context, t fataler, db *sql.DB) {
+	stmt := `
+CREATE TABLE IF NOT EXISTS hier_lock_intents (
+  level TINYINT NOT NULL,
+  bucket INT NOT NULL,
+  slot TINYINT NOT NULL,
+  PRIMARY KEY (level, bucket, slot)
+) ENGINE=InnoDB;
+`
+	if _, err := db.ExecContext(ctx, stmt); err != nil {
+		t.Fatalf("create table hier_lock_intents: %v", err)
+	}
+	if _, err := db.ExecContext(ctx, "TRUNCATE TABLE hier_lock_intents"); err != nil {
+		t.Fatalf("truncate hier_lock_intents: %v", err)
+	}
+}
+
+// seedIntents provisions intent slots 0..slots-1 for each target.
+func seedIntents(ctx context.Context, t fataler, db *sql.DB, slots int, targets ...lockTarget) {
+	for _, tgt := range targets {
+		for slot := 0; slot < slots; slot++ {
+			if _, err := db.ExecContext(ctx,
+				"INSERT IGNORE INTO hier_lock_intents(level, bucket, slot) VALUES (?, ?, ?)",
+				int(tgt.level), tgt.bucket, slot,
+			); err != nil {
+				t.Fatalf("insert intent row level=%d bucket=%d slot=%d: %v", tgt.level, tgt.bucket, slot, err)
+			}
+		}
+	}
+}
+
 func isLockConflict(err error) bool {
 	var me *mysql.MySQLError
 	if ok := asMySQLError(err, &me); !ok {
@@ -101,19 +132,11 @@ func isLockConflict(err error) bool {
 }
 
 func isDeadlock(err error) bool {
-	var me *mysql.MySQLError
-	if !errors.As(err, &me) {
-		return false
-	}
-	return me.Number == 1213
+	return errors.Is(err, ErrDeadlock)
 }
 
 func isLockWaitTimeout(err error) bool {
-	var me *mysql.MySQLError
-	if !errors.As(err, &me) {
-		return false
-	}
-	return me.Number == 1205
+	return errors.Is(err, ErrLockWaitTimeout)
 }
 
 func asMySQLError(err error, target **mysql.MySQLError) bool {
@@ -199,3 +222,17 @@ func pickDifferentResourceID(userID, accountID, baseResourceID string) string {
 		}
 	}
 }
+
+// findCollidingResourceIDs returns two distinct resource IDs under
+// (userID, accountID) that map to the same Resource bucket.
+func findCollidingResourceIDs(userID, accountID string) (string, string) {
+	seen := map[int]string{}
+	for i := 0; ; i++ {
+		cand := fmt.Sprintf("collide_%d", i)
+		b := resourceTarget(userID, accountID, cand).bucket
+		if prev, ok := seen[b]; ok {
+			return prev, cand
+		}
+		seen[b] = cand
+	}
+}
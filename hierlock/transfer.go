@@ -0,0 +1,66 @@
+package hierlock
+
+import (
+	"context"
+	"slices"
+)
+
+// AcquireTransfer locks both ends of a transfer or move, Accounts or
+// Resources, possibly of different users, exclusively in one transaction.
+//
+// Both paths go through the same planning as AcquireSet: shared ancestors
+// (the User of a transfer between two accounts of one user, or an Account
+// that is also an end of the transfer) are locked once in the strongest mode
+// needed, and all rows are locked in (level, bucket) order. The order does
+// not depend on which end is from and which is to, so opposite-direction
+// transfers between the same pair wait for each other instead of
+// deadlocking.
+//
+// The Mode of from and to is ignored. from and to must differ.
+func (m *Manager) AcquireTransfer(ctx context.Context, from, to LockRequest, opts ...AcquireOption) (*LockHandle, error) {
+	cfg, err := newAcquireConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	return m.acquireTransfer(ctx, from, to, cfg)
+}
+
+// TryAcquireTransfer is the NOWAIT variant of AcquireTransfer. See TryAcquire.
+func (m *Manager) TryAcquireTransfer(ctx context.Context, from, to LockRequest, opts ...AcquireOption) (*LockHandle, error) {
+	cfg, err := newAcquireConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	cfg.wait = waitNoWait
+	return m.acquireTransfer(ctx, from, to, cfg)
+}
+
+func (m *Manager) acquireTransfer(ctx context.Context, from, to LockRequest, cfg acquireConfig) (*LockHandle, error) {
+	reqs, err := transferRequests(from, to)
+	if err != nil {
+		return nil, err
+	}
+	return m.acquireSet(ctx, reqs, cfg)
+}
+
+// transferRequests validates the ends of a transfer and returns them as
+// exclusive requests.
+func transferRequests(from, to LockRequest) ([]LockRequest, error) {
+	reqs := []LockRequest{from, to}
+	var paths []Path
+	for i := range reqs {
+		if reqs[i].Path == nil && reqs[i].Level != LevelAccount && reqs[i].Level != LevelResource {
+			return nil, invalidArgf("transfer ends must be Accounts or Resources")
+		}
+		p, err := reqs[i].path()
+		if err != nil {
+			return nil, err
+		}
+		reqs[i].Mode = ModeExclusive
+		paths = append(paths, p)
+	}
+	if slices.Equal(paths[0], paths[1]) {
+		return nil, invalidArgf("transfer from and to are the same target")
+	}
+	return reqs, nil
+}
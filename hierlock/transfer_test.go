@@ -0,0 +1,118 @@
+package hierlock
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func transferPlan(t *testing.T, m *Manager, from, to LockRequest) []lockStep {
+	t.Helper()
+	reqs, err := transferRequests(from, to)
+	if err != nil {
+		t.Fatalf("transferRequests: %v", err)
+	}
+	steps, err := m.setSteps(reqs)
+	if err != nil {
+		t.Fatalf("setSteps: %v", err)
+	}
+	planned, _ := planSteps(steps)
+	return planned
+}
+
+func TestAcquireTransfer_OrderIndependentOfDirection(t *testing.T) {
+	m := NewManager(nil)
+	a := LockRequest{Level: LevelResource, UserID: "u1", AccountID: "a1", ResourceID: "r1"}
+	b := LockRequest{Level: LevelAccount, UserID: "u2", AccountID: "a9"}
+
+	forward := transferPlan(t, m, a, b)
+	backward := transferPlan(t, m, b, a)
+	if len(forward) != len(backward) {
+		t.Fatalf("plans differ in length: %d vs %d", len(forward), len(backward))
+	}
+	for i := range forward {
+		if forward[i].target != backward[i].target || forward[i].mode != backward[i].mode {
+			t.Fatalf("step %d differs: %s(%v) vs %s(%v)", i, forward[i].name, forward[i].mode, backward[i].name, backward[i].mode)
+		}
+	}
+}
+
+func TestAcquireTransfer_SharedAncestors(t *testing.T) {
+	m := NewManager(nil)
+
+	// Two accounts of one user share User(u1), locked once and shared.
+	plan := transferPlan(t, m,
+		LockRequest{Level: LevelAccount, UserID: "u1", AccountID: "a1"},
+		LockRequest{Level: LevelAccount, UserID: "u1", AccountID: "a2"},
+	)
+	if len(plan) != 3 || plan[0].name != "User(u1)" || plan[0].mode != ModeShared {
+		t.Fatalf("plan = %+v", plan)
+	}
+
+	// Moving a resource into its own account: the Account is an end and an
+	// ancestor, and is locked once, exclusively.
+	plan = transferPlan(t, m,
+		LockRequest{Level: LevelResource, UserID: "u1", AccountID: "a1", ResourceID: "r1"},
+		LockRequest{Level: LevelAccount, UserID: "u1", AccountID: "a1"},
+	)
+	if len(plan) != 3 || plan[1].name != "Account(u1/a1)" || plan[1].mode != ModeExclusive {
+		t.Fatalf("plan = %+v", plan)
+	}
+
+	for _, bad := range [][2]LockRequest{
+		{{Level: LevelUser, UserID: "u1"}, {Level: LevelAccount, UserID: "u1", AccountID: "a1"}},
+		{{Level: LevelAccount, UserID: "u1", AccountID: "a1"}, {Level: LevelAccount, UserID: "u1", AccountID: "a1"}},
+	} {
+		if _, err := transferRequests(bad[0], bad[1]); !errors.Is(err, ErrInvalidArgument) {
+			t.Fatalf("transferRequests(%+v): expected ErrInvalidArgument, got %v", bad, err)
+		}
+	}
+}
+
+// Contrast with TestHierarchy_Deadlock_UnorderedMultiResource: transfers in
+// opposite directions between the same pair, running concurrently, only wait
+// for each other.
+func TestAcquireTransfer_OppositeDirectionsNeverDeadlock(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	setupLockTable(ctx, t, db)
+
+	u2 := pickDifferentUserIDNonColliding("u1", "a1", "r1")
+	seedBuckets(ctx, t, db, mustTargets(LevelResource, "u1", "a1", "r1")...)
+	seedBuckets(ctx, t, db, mustTargets(LevelResource, u2, "a1", "r1")...)
+	x := LockRequest{Level: LevelResource, UserID: "u1", AccountID: "a1", ResourceID: "r1"}
+	y := LockRequest{Level: LevelResource, UserID: u2, AccountID: "a1", ResourceID: "r1"}
+
+	repo := NewRepository(db)
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	for _, dir := range [][2]LockRequest{{x, y}, {y, x}} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				h, err := repo.GetTransferLock(ctx, dir[0], dir[1], WithLockWaitTimeout(5*time.Second))
+				if err != nil {
+					errs <- err
+					return
+				}
+				// Hold briefly so the other direction is waiting.
+				time.Sleep(10 * time.Millisecond)
+				_ = h.Release()
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if isDeadlock(err) {
+			t.Fatalf("opposite-direction transfers deadlocked: %v", err)
+		}
+		t.Fatalf("GetTransferLock: %v", err)
+	}
+}
@@ -0,0 +1,158 @@
+package hierlock
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func targetMode(t *testing.T, h *LockHandle, name string) LockMode {
+	t.Helper()
+	for _, hl := range h.Held() {
+		if hl.Target == name {
+			return hl.Mode
+		}
+	}
+	t.Fatalf("handle does not hold %s: %+v", name, h.Held())
+	return 0
+}
+
+func TestLockHandle_UpgradeWaitsForOtherReaders(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	setupLockTable(ctx, t, db)
+	seedBuckets(ctx, t, db, mustTargets(LevelAccount, "u1", "a1", "")...)
+
+	m := NewManager(db)
+
+	reader, err := m.Acquire(ctx, LevelAccount, "u1", "a1", "", WithMode(ModeShared))
+	if err != nil {
+		t.Fatalf("reader acquire: %v", err)
+	}
+	defer reader.Release()
+
+	h, err := m.Acquire(ctx, LevelAccount, "u1", "a1", "", WithMode(ModeShared))
+	if err != nil {
+		t.Fatalf("acquire shared: %v", err)
+	}
+	defer h.Release()
+	if got := targetMode(t, h, "Account(u1/a1)"); got != ModeShared {
+		t.Fatalf("mode before upgrade = %v, want S", got)
+	}
+	if got := targetMode(t, h, "User(u1)"); got != ModeShared {
+		t.Fatalf("ancestor mode = %v, want S", got)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- h.Upgrade(ctx) }()
+
+	select {
+	case err := <-done:
+		t.Fatalf("expected Upgrade to wait for the other reader, returned: %v", err)
+	case <-time.After(150 * time.Millisecond):
+		// ok
+	}
+
+	_ = reader.Release()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Upgrade: %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("Upgrade did not finish after the reader released")
+	}
+
+	if got := targetMode(t, h, "Account(u1/a1)"); got != ModeExclusive {
+		t.Fatalf("mode after upgrade = %v, want X", got)
+	}
+	if got := targetMode(t, h, "User(u1)"); got != ModeShared {
+		t.Fatalf("ancestor mode after upgrade = %v, want S", got)
+	}
+	if _, err := m.TryAcquire(ctx, LevelAccount, "u1", "a1", "", WithMode(ModeShared)); !errors.Is(err, ErrWouldBlock) {
+		t.Fatalf("expected upgraded lock to exclude readers, got: %v", err)
+	}
+}
+
+func TestLockHandle_ConcurrentUpgradeDeadlocks(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	setupLockTable(ctx, t, db)
+	seedBuckets(ctx, t, db, mustTargets(LevelAccount, "u1", "a1", "")...)
+
+	m := NewManager(db)
+
+	h1, err := m.Acquire(ctx, LevelAccount, "u1", "a1", "", WithMode(ModeShared))
+	if err != nil {
+		t.Fatalf("h1 acquire: %v", err)
+	}
+	defer h1.Release()
+	h2, err := m.Acquire(ctx, LevelAccount, "u1", "a1", "", WithMode(ModeShared))
+	if err != nil {
+		t.Fatalf("h2 acquire: %v", err)
+	}
+	defer h2.Release()
+
+	// Both shared holders ask for X: each waits for the other's S lock.
+	resCh := make(chan error, 2)
+	go func() { resCh <- h1.Upgrade(ctx) }()
+	time.Sleep(100 * time.Millisecond)
+	go func() { resCh <- h2.Upgrade(ctx) }()
+
+	err1 := <-resCh
+	err2 := <-resCh
+	deadlocks := 0
+	for _, err := range []error{err1, err2} {
+		switch {
+		case err == nil:
+		case errors.Is(err, ErrDeadlock):
+			deadlocks++
+		default:
+			t.Fatalf("unexpected upgrade error: %v", err)
+		}
+	}
+	if deadlocks != 1 {
+		t.Fatalf("expected exactly one upgrade to fail with ErrDeadlock, got err1=%v err2=%v", err1, err2)
+	}
+}
+
+func TestLockHandle_Downgrade(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	setupLockTable(ctx, t, db)
+	seedBuckets(ctx, t, db, mustTargets(LevelAccount, "u1", "a1", "")...)
+
+	m := NewManager(db)
+
+	h, err := m.Acquire(ctx, LevelAccount, "u1", "a1", "")
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	defer h.Release()
+
+	if err := h.Downgrade(ctx); err != nil {
+		t.Fatalf("Downgrade: %v", err)
+	}
+	if got := targetMode(t, h, "Account(u1/a1)"); got != ModeShared {
+		t.Fatalf("mode after downgrade = %v, want S", got)
+	}
+
+	reader, err := m.TryAcquire(ctx, LevelAccount, "u1", "a1", "", WithMode(ModeShared))
+	if err != nil {
+		t.Fatalf("reader should coexist with the downgraded lock: %v", err)
+	}
+	defer reader.Release()
+	if _, err := m.TryAcquire(ctx, LevelAccount, "u1", "a1", ""); !errors.Is(err, ErrWouldBlock) {
+		t.Fatalf("downgraded lock must still exclude writers, got: %v", err)
+	}
+}
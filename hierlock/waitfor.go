@@ -0,0 +1,199 @@
+package hierlock
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Deadlock detection (WithDeadlockDetection).
+//
+// The manager records, for each of its acquisitions, the rows it holds and
+// the row its current blocking statement waits for. Waiting for a row means
+// waiting for every other acquisition holding it in a conflicting mode,
+// which gives a wait-for graph. Before a blocking statement is sent, the
+// graph is searched for a path from the row's holders back to the
+// requester; if one exists the statement would complete a cycle, so it is
+// not sent and the requester fails with a *DeadlockError instead. The
+// requester's transaction is rolled back like after a 1213, which breaks the
+// cycle.
+//
+// Every edge is checked when it is added, so every cycle among tracked
+// acquisitions is found by the acquisition that closes it. Acquisitions from
+// the TryAcquire family are tracked as holders; their NOWAIT statements never
+// wait, so they cannot close a cycle themselves. Rows are registered right
+// after their statement returns, so a cycle closed in that window, or one
+// involving other processes, AcquireInTx or ClaimResources, is still left to
+// MySQL.
+
+// DeadlockError reports a wait-for cycle among the manager's own
+// acquisitions. It matches ErrDeadlock with errors.Is and is retried by
+// DefaultShouldRetry.
+type DeadlockError struct {
+	// Cycle lists the participants starting with the acquisition that
+	// detected the cycle. Each one waits for a row held by the next; the
+	// last waits for the first.
+	Cycle []DeadlockParticipant
+}
+
+// DeadlockParticipant is one acquisition of a wait-for cycle.
+type DeadlockParticipant struct {
+	// Goroutine is the ID of the goroutine that last locked for the
+	// acquisition.
+	Goroutine uint64
+	// WaitingFor names the node the acquisition waits for, e.g.
+	// "Resource(u1/a1/r2)", and Mode the mode it asked for.
+	WaitingFor string
+	Mode       LockMode
+	// Held lists the rows the acquisition holds.
+	Held []HeldLock
+}
+
+func (e *DeadlockError) Error() string {
+	var b strings.Builder
+	b.WriteString("hierlock: deadlock detected in process:")
+	for i, p := range e.Cycle {
+		next := e.Cycle[(i+1)%len(e.Cycle)]
+		fmt.Fprintf(&b, " goroutine %d waits for %s %s held by goroutine %d", p.Goroutine, p.Mode, p.WaitingFor, next.Goroutine)
+		if held := heldNames(p.Held); held != "" {
+			fmt.Fprintf(&b, " (holding %s)", held)
+		}
+		if i < len(e.Cycle)-1 {
+			b.WriteString(";")
+		}
+	}
+	return b.String()
+}
+
+func (e *DeadlockError) Is(target error) bool {
+	return target == ErrDeadlock
+}
+
+func heldNames(held []HeldLock) string {
+	names := make([]string, 0, len(held))
+	for _, hl := range held {
+		names = append(names, hl.Mode.String()+" "+hl.Target)
+	}
+	return strings.Join(names, ", ")
+}
+
+// acquireStepsTracked makes a single attempt registered for deadlock
+// detection.
+func (m *Manager) acquireStepsTracked(ctx context.Context, steps []lockStep, cfg acquireConfig) (*LockHandle, error) {
+	cfg.txn = m.txns.begin()
+	return m.acquireStepsOnce(ctx, steps, cfg)
+}
+
+// waitFor records that t is about to wait for st and fails with a
+// *DeadlockError if that would close a cycle. It is a no-op for a nil t.
+func (t *txn) waitFor(st lockStep) error {
+	if t == nil {
+		return nil
+	}
+	r := t.reg
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t.goroutine = goroutineID()
+	t.waiting = &st
+	if cycle := r.cycleFrom(t); cycle != nil {
+		err := r.deadlockError(cycle)
+		t.waiting = nil
+		return err
+	}
+	return nil
+}
+
+// granted clears t's wait for st and, if the lock was taken, registers it.
+func (t *txn) granted(st lockStep, ok bool) {
+	if t == nil {
+		return
+	}
+	r := t.reg
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t.waiting = nil
+	if ok {
+		r.addLocked(t, st)
+	}
+}
+
+// blockers returns the acquisitions t waits for. r.mu must be held.
+func (r *txnRegistry) blockers(t *txn) []*txn {
+	if t.waiting == nil {
+		return nil
+	}
+	var out []*txn
+	for _, h := range r.holds[t.waiting.target] {
+		if h.txn != t && t.waiting.conflicts(h.step) && !slices.Contains(out, h.txn) {
+			out = append(out, h.txn)
+		}
+	}
+	return out
+}
+
+// cycleFrom returns a wait-for cycle through t, starting with t, or nil.
+// r.mu must be held.
+func (r *txnRegistry) cycleFrom(t *txn) []*txn {
+	visited := map[*txn]bool{}
+	var path []*txn
+	var visit func(u *txn) bool
+	visit = func(u *txn) bool {
+		path = append(path, u)
+		for _, v := range r.blockers(u) {
+			if v == t {
+				return true
+			}
+			if !visited[v] {
+				visited[v] = true
+				if visit(v) {
+					return true
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		return false
+	}
+	visited[t] = true
+	if visit(t) {
+		return path
+	}
+	return nil
+}
+
+// deadlockError describes cycle. r.mu must be held.
+func (r *txnRegistry) deadlockError(cycle []*txn) *DeadlockError {
+	e := &DeadlockError{}
+	for _, u := range cycle {
+		p := DeadlockParticipant{Goroutine: u.goroutine, WaitingFor: u.waiting.name, Mode: u.waiting.mode}
+		seen := map[lockTarget]bool{}
+		for _, target := range u.targets {
+			if seen[target] {
+				continue
+			}
+			seen[target] = true
+			for _, h := range r.holds[target] {
+				if h.txn == u {
+					p.Held = append(p.Held, HeldLock{Target: h.step.name, Level: target.level, Bucket: target.bucket, Mode: h.step.mode, Requested: h.step.requested})
+				}
+			}
+		}
+		e.Cycle = append(e.Cycle, p)
+	}
+	return e
+}
+
+// goroutineID returns the current goroutine's ID as printed in stack traces.
+func goroutineID() uint64 {
+	var buf [64]byte
+	b := buf[:runtime.Stack(buf[:], false)]
+	b = bytes.TrimPrefix(b, []byte("goroutine "))
+	if i := bytes.IndexByte(b, ' '); i >= 0 {
+		b = b[:i]
+	}
+	id, _ := strconv.ParseUint(string(b), 10, 64)
+	return id
+}
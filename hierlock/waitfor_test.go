@@ -0,0 +1,174 @@
+package hierlock
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWaitForGraph_DetectsCycle(t *testing.T) {
+	r := newTxnRegistry(0)
+	r1 := defaultHierarchy.step(Path{"u1", "a1", "r1"}, ModeExclusive, true)
+	r2 := defaultHierarchy.step(Path{"u1", "a1", "r2"}, ModeExclusive, true)
+	r3 := defaultHierarchy.step(Path{"u1", "a1", "r3"}, ModeExclusive, true)
+
+	a, b, c := r.begin(), r.begin(), r.begin()
+	a.granted(r1, true)
+	b.granted(r2, true)
+	c.granted(r3, true)
+
+	if err := a.waitFor(r2); err != nil {
+		t.Fatalf("a waits for b: %v", err)
+	}
+	if err := b.waitFor(r3); err != nil {
+		t.Fatalf("b waits for c: %v", err)
+	}
+	err := c.waitFor(r1)
+	var de *DeadlockError
+	if !errors.As(err, &de) || !errors.Is(err, ErrDeadlock) {
+		t.Fatalf("c waits for a: expected *DeadlockError, got %v", err)
+	}
+	if len(de.Cycle) != 3 {
+		t.Fatalf("cycle = %+v, want 3 participants", de.Cycle)
+	}
+	for i, want := range []string{"Resource(u1/a1/r1)", "Resource(u1/a1/r2)", "Resource(u1/a1/r3)"} {
+		p := de.Cycle[i]
+		if p.WaitingFor != want || p.Mode != ModeExclusive {
+			t.Fatalf("participant %d waits for %s %s, want X %s", i, p.Mode, p.WaitingFor, want)
+		}
+		if len(p.Held) != 1 {
+			t.Fatalf("participant %d holds %+v", i, p.Held)
+		}
+	}
+	if msg := err.Error(); !strings.Contains(msg, "Resource(u1/a1/r2)") || !strings.Contains(msg, "goroutine") {
+		t.Fatalf("error does not name the participants: %s", msg)
+	}
+	if !DefaultShouldRetry(0, err) {
+		t.Fatalf("DefaultShouldRetry must retry a detected deadlock")
+	}
+	if c.waiting != nil {
+		t.Fatalf("the detecting acquisition must not be left waiting")
+	}
+
+	// Once a gives up, c's wait is fine.
+	a.end()
+	if err := c.waitFor(r1); err != nil {
+		t.Fatalf("no cycle after a ended: %v", err)
+	}
+}
+
+func TestWaitForGraph_SharedHoldersDoNotBlock(t *testing.T) {
+	r := newTxnRegistry(0)
+	s := defaultHierarchy.step(Path{"u1", "a1"}, ModeShared, true)
+	x := defaultHierarchy.step(Path{"u1", "a1", "r1"}, ModeExclusive, true)
+
+	a, b := r.begin(), r.begin()
+	a.granted(s, true)
+	b.granted(s, true)
+	a.granted(x, true)
+	if err := a.waitFor(s); err != nil {
+		t.Fatalf("shared wait: %v", err)
+	}
+	if err := b.waitFor(x); err != nil {
+		t.Fatalf("b waits for a, which waits for nothing that conflicts: %v", err)
+	}
+}
+
+func TestDeadlockDetection_CrossedUpgrades(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	setupLockTable(ctx, t, db)
+	seedBuckets(ctx, t, db, mustTargets(LevelAccount, "u1", "a1", "")...)
+
+	m := NewManager(db, WithDeadlockDetection())
+	first, err := m.Acquire(ctx, LevelAccount, "u1", "a1", "", WithMode(ModeShared))
+	if err != nil {
+		t.Fatalf("first acquire: %v", err)
+	}
+	defer first.Release()
+	second, err := m.Acquire(ctx, LevelAccount, "u1", "a1", "", WithMode(ModeShared))
+	if err != nil {
+		t.Fatalf("second acquire: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- first.Upgrade(ctx) }()
+	time.Sleep(150 * time.Millisecond)
+
+	err = second.Upgrade(ctx)
+	var de *DeadlockError
+	if !errors.As(err, &de) {
+		t.Fatalf("second Upgrade: expected *DeadlockError, got %v", err)
+	}
+	if len(de.Cycle) != 2 || de.Cycle[0].WaitingFor != "Account(u1/a1)" {
+		t.Fatalf("cycle = %+v", de.Cycle)
+	}
+	_ = second.Release()
+	if err := <-done; err != nil {
+		t.Fatalf("first Upgrade: %v", err)
+	}
+}
+
+func TestDeadlockDetection_AddResourcesKeepsOrder(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	setupLockTable(ctx, t, db)
+	seedBuckets(ctx, t, db,
+		userTarget("u1"),
+		accountTarget("u1", "a1"),
+		resourceTarget("u1", "a1", "r1"),
+		resourceTarget("u1", "a1", "r5"),
+	)
+
+	// The detector cannot see other processes, so the order still applies.
+	m := NewManager(db, WithDeadlockDetection())
+	h, err := m.AcquireResources(ctx, "u1", "a1", []string{"r5"})
+	if err != nil {
+		t.Fatalf("AcquireResources: %v", err)
+	}
+	defer h.Release()
+	if err := h.AddResources(ctx, "r1"); !errors.Is(err, ErrLockOrderViolation) {
+		t.Fatalf("expected ErrLockOrderViolation, got: %v", err)
+	}
+	other, err := m.TryAcquire(ctx, LevelResource, "u1", "a1", "r1")
+	if err != nil {
+		t.Fatalf("r1 must not be locked after the violation: %v", err)
+	}
+	_ = other.Release()
+}
+
+func TestDeadlockDetection_TracksTryAcquisitions(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	setupLockTable(ctx, t, db)
+	seedBuckets(ctx, t, db, mustTargets(LevelAccount, "u1", "a1", "")...)
+
+	m := NewManager(db, WithDeadlockDetection())
+	h, err := m.TryAcquire(ctx, LevelAccount, "u1", "a1", "")
+	if err != nil {
+		t.Fatalf("TryAcquire: %v", err)
+	}
+	holders := func() int {
+		m.txns.mu.Lock()
+		defer m.txns.mu.Unlock()
+		return len(m.txns.holds[accountTarget("u1", "a1")])
+	}
+	if n := holders(); n != 1 {
+		t.Fatalf("holders of Account(u1/a1) = %d, want the Try handle", n)
+	}
+	_ = h.Release()
+	if n := holders(); n != 0 {
+		t.Fatalf("holders after Release = %d, want 0", n)
+	}
+}
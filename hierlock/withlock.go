@@ -0,0 +1,100 @@
+package hierlock
+
+import (
+	"context"
+	"database/sql"
+)
+
+// LockRequest identifies one hierarchy target and the mode to lock it in.
+// IDs below Level are ignored. Path, when set, addresses a node of the
+// manager's hierarchy instead of Level and the IDs.
+type LockRequest struct {
+	Level      Level
+	UserID     string
+	AccountID  string
+	ResourceID string
+	Path       Path
+	Mode       LockMode
+}
+
+func (r LockRequest) path() (Path, error) {
+	if r.Path != nil {
+		return r.Path, nil
+	}
+	return typedPath(r.Level, r.UserID, r.AccountID, r.ResourceID)
+}
+
+// WithLock acquires req and runs fn on the lock transaction itself, so the
+// business writes and the locks protecting them commit atomically.
+//
+// The transaction is committed if fn returns nil, and rolled back if fn
+// returns an error or panics (the panic keeps propagating). The lock transaction
+// uses READ COMMITTED. Only the acquisition is retried under the manager's
+// RetryPolicy; fn runs at most once.
+func (m *Manager) WithLock(ctx context.Context, req LockRequest, fn func(ctx context.Context, tx *sql.Tx) error, opts ...AcquireOption) (err error) {
+	path, err := req.path()
+	if err != nil {
+		return err
+	}
+	opts = append([]AcquireOption{WithMode(req.Mode)}, opts...)
+	h, err := m.AcquirePath(ctx, path, opts...)
+	if err != nil {
+		return err
+	}
+
+	committed := false
+	defer func() {
+		if !committed {
+			_ = h.tx.Rollback()
+		}
+		h.closeConn()
+		h.untrack()
+	}()
+
+	if err := fn(ctx, h.tx); err != nil {
+		return err
+	}
+	if err := h.tx.Commit(); err != nil {
+		return err
+	}
+	committed = true
+	return nil
+}
+
+// AcquireInTx locks the hierarchy inside a transaction the caller already
+// began, using the same rules as Acquire.
+//
+// The locks are held until the caller commits or rolls back tx; Release on
+// the returned handle does nothing. On error, locks taken before the failing
+// statement may still be held (after a deadlock MySQL has already rolled the
+// transaction back), so the caller should roll back. The manager's
+// RetryPolicy does not apply because tx cannot be restarted here. If a lock
+// wait timeout option was used and innodb_lock_wait_timeout could not be put
+// back afterwards, the error says so; the caller's connection keeps the
+// shortened value and should not be reused.
+func (m *Manager) AcquireInTx(ctx context.Context, tx *sql.Tx, level Level, userID, accountID, resourceID string, opts ...AcquireOption) (*LockHandle, error) {
+	if err := m.check(); err != nil {
+		return nil, err
+	}
+	if tx == nil {
+		return nil, invalidArgf("tx is nil")
+	}
+	cfg, err := newAcquireConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	path, err := typedPath(level, userID, accountID, resourceID)
+	if err != nil {
+		return nil, err
+	}
+	steps, err := m.pathSteps(path, cfg.mode)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockSteps(ctx, tx, steps, cfg); err != nil {
+		return nil, err
+	}
+	h := &LockHandle{tx: tx, borrowed: true, m: m, steps: steps, cfg: cfg}
+	h.scope = m.h.scopeFor(path)
+	return h, nil
+}
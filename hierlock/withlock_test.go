@@ -0,0 +1,188 @@
+package hierlock
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+)
+
+func setupCounterTable(ctx context.Context, t fataler, db *sql.DB) {
+	if _, err := db.ExecContext(ctx, `
+CREATE TABLE IF NOT EXISTS hier_lock_test_counters (
+  id VARCHAR(64) NOT NULL PRIMARY KEY,
+  n INT NOT NULL
+) ENGINE=InnoDB;
+`); err != nil {
+		t.Fatalf("create table hier_lock_test_counters: %v", err)
+	}
+	if _, err := db.ExecContext(ctx, "TRUNCATE TABLE hier_lock_test_counters"); err != nil {
+		t.Fatalf("truncate hier_lock_test_counters: %v", err)
+	}
+}
+
+func incrementCounter(ctx context.Context, tx *sql.Tx, id string) error {
+	_, err := tx.ExecContext(ctx,
+		"INSERT INTO hier_lock_test_counters(id, n) VALUES (?, 1) ON DUPLICATE KEY UPDATE n = n + 1", id)
+	return err
+}
+
+func readCounter(ctx context.Context, t fataler, db *sql.DB, id string) int {
+	var n int
+	err := db.QueryRowContext(ctx, "SELECT n FROM hier_lock_test_counters WHERE id = ?", id).Scan(&n)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0
+	}
+	if err != nil {
+		t.Fatalf("read counter %s: %v", id, err)
+	}
+	return n
+}
+
+func TestWithLock_CommitsOrRollsBackBusinessWrites(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	setupLockTable(ctx, t, db)
+	setupCounterTable(ctx, t, db)
+	seedBuckets(ctx, t, db, mustTargets(LevelAccount, "u1", "a1", "")...)
+
+	m := NewManager(db)
+	req := LockRequest{Level: LevelAccount, UserID: "u1", AccountID: "a1"}
+
+	if err := m.WithLock(ctx, req, func(ctx context.Context, tx *sql.Tx) error {
+		return incrementCounter(ctx, tx, "a1")
+	}); err != nil {
+		t.Fatalf("WithLock: %v", err)
+	}
+	if n := readCounter(ctx, t, db, "a1"); n != 1 {
+		t.Fatalf("counter after commit = %d, want 1", n)
+	}
+
+	boom := errors.New("boom")
+	err := m.WithLock(ctx, req, func(ctx context.Context, tx *sql.Tx) error {
+		if err := incrementCounter(ctx, tx, "a1"); err != nil {
+			return err
+		}
+		return boom
+	})
+	if !errors.Is(err, boom) {
+		t.Fatalf("expected callback error, got: %v", err)
+	}
+	if n := readCounter(ctx, t, db, "a1"); n != 1 {
+		t.Fatalf("counter after error = %d, want 1 (rolled back)", n)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("expected panic to propagate")
+			}
+		}()
+		_ = m.WithLock(ctx, req, func(ctx context.Context, tx *sql.Tx) error {
+			if err := incrementCounter(ctx, tx, "a1"); err != nil {
+				return err
+			}
+			panic("boom")
+		})
+	}()
+	if n := readCounter(ctx, t, db, "a1"); n != 1 {
+		t.Fatalf("counter after panic = %d, want 1 (rolled back)", n)
+	}
+
+	// The locks must be gone after every path above.
+	h, err := m.TryAcquire(ctx, LevelAccount, "u1", "a1", "")
+	if err != nil {
+		t.Fatalf("TryAcquire after WithLock: %v", err)
+	}
+	_ = h.Release()
+}
+
+func TestWithLock_HoldsLockDuringCallback(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	setupLockTable(ctx, t, db)
+	seedBuckets(ctx, t, db, mustTargets(LevelResource, "u1", "a1", "r1")...)
+
+	m := NewManager(db)
+
+	inside := make(chan struct{})
+	leave := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- m.WithLock(ctx, LockRequest{Level: LevelResource, UserID: "u1", AccountID: "a1", ResourceID: "r1"},
+			func(ctx context.Context, tx *sql.Tx) error {
+				close(inside)
+				<-leave
+				return nil
+			})
+	}()
+	<-inside
+
+	if _, err := m.TryAcquire(ctx, LevelResource, "u1", "a1", "r1"); !errors.Is(err, ErrWouldBlock) {
+		t.Fatalf("expected resource to be locked during callback, got: %v", err)
+	}
+
+	close(leave)
+	if err := <-done; err != nil {
+		t.Fatalf("WithLock: %v", err)
+	}
+	h, err := m.TryAcquire(ctx, LevelResource, "u1", "a1", "r1")
+	if err != nil {
+		t.Fatalf("TryAcquire after commit: %v", err)
+	}
+	_ = h.Release()
+}
+
+func TestAcquireInTx_LocksLiveWithCallerTransaction(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	setupLockTable(ctx, t, db)
+	setupCounterTable(ctx, t, db)
+	seedBuckets(ctx, t, db, mustTargets(LevelAccount, "u1", "a1", "")...)
+
+	m := NewManager(db)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("BeginTx: %v", err)
+	}
+	defer tx.Rollback()
+
+	h, err := m.AcquireInTx(ctx, tx, LevelAccount, "u1", "a1", "")
+	if err != nil {
+		t.Fatalf("AcquireInTx: %v", err)
+	}
+	if err := incrementCounter(ctx, tx, "a1"); err != nil {
+		t.Fatalf("increment: %v", err)
+	}
+
+	// Release must not end the caller's transaction.
+	if err := h.Release(); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if _, err := m.TryAcquire(ctx, LevelAccount, "u1", "a1", ""); !errors.Is(err, ErrWouldBlock) {
+		t.Fatalf("expected account to stay locked until commit, got: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	if n := readCounter(ctx, t, db, "a1"); n != 1 {
+		t.Fatalf("counter = %d, want 1", n)
+	}
+	h2, err := m.TryAcquire(ctx, LevelAccount, "u1", "a1", "")
+	if err != nil {
+		t.Fatalf("TryAcquire after commit: %v", err)
+	}
+	_ = h2.Release()
+}